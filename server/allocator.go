@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// ReleasedIP 记录被删除用户释放的地址，隔离期内不会被自动分配
+type ReleasedIP struct {
+	ID         uint      `gorm:"primaryKey"`
+	IP         string    `gorm:"uniqueIndex;not null"`
+	Interface  string    `gorm:"not null"`
+	ReleasedAt time.Time `gorm:"index;not null"`
+}
+
+// ErrAddressUnavailable 静态指定的地址不可用
+var ErrAddressUnavailable = errors.New("address unavailable")
+
+// addrRange 闭区间 [from, to]
+type addrRange struct {
+	from, to netip.Addr
+}
+
+func (r addrRange) contains(addr netip.Addr) bool {
+	return r.from.Compare(addr) <= 0 && addr.Compare(r.to) <= 0
+}
+
+// ipAllocator 在一个地址池中分配地址。
+// 网络地址、IPv4 广播地址和服务端地址永远不会分配；
+// reserved 中的地址不参与自动分配，但可以通过静态指定使用
+type ipAllocator struct {
+	pool        netip.Prefix
+	fixed       map[netip.Addr]bool
+	reserved    []addrRange
+	used        map[netip.Addr]bool // 已分配给用户的地址
+	quarantined map[netip.Addr]bool // 隔离期内的地址，只影响自动分配
+}
+
+// newIPAllocator 创建地址池的分配器，serverAddrs 是服务端接口地址（CIDR 形式）
+func newIPAllocator(pool string, serverAddrs []string, reserved []string, used, quarantined map[netip.Addr]bool) (*ipAllocator, error) {
+	prefix, err := netip.ParsePrefix(pool)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip pool %q: %w", pool, err)
+	}
+	prefix = prefix.Masked()
+
+	a := &ipAllocator{
+		pool:        prefix,
+		fixed:       make(map[netip.Addr]bool),
+		used:        used,
+		quarantined: quarantined,
+	}
+	// /31、/32 和 /127、/128 没有网络地址和广播地址
+	if prefix.Bits() < prefix.Addr().BitLen()-1 {
+		a.fixed[prefix.Addr()] = true
+		if prefix.Addr().Is4() {
+			a.fixed[lastAddr(prefix)] = true
+		}
+	}
+	for _, serverAddr := range serverAddrs {
+		if serverAddr == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(strings.TrimSpace(serverAddr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid server address %q: %w", serverAddr, err)
+		}
+		a.fixed[p.Addr()] = true
+	}
+	for _, entry := range reserved {
+		r, err := parseAddrRange(entry)
+		if err != nil {
+			return nil, err
+		}
+		a.reserved = append(a.reserved, r)
+	}
+	return a, nil
+}
+
+// Next 返回地址池中第一个可自动分配的地址。
+// 跳过整段保留区间，开销只与已分配的地址数和保留区间数有关
+func (a *ipAllocator) Next() (netip.Addr, error) {
+	addr := a.pool.Addr()
+	for addr.IsValid() && a.pool.Contains(addr) {
+		if r, ok := a.reservedRange(addr); ok {
+			addr = r.to.Next()
+			continue
+		}
+		if !a.fixed[addr] && !a.used[addr] && !a.quarantined[addr] {
+			return addr, nil
+		}
+		addr = addr.Next()
+	}
+	return netip.Addr{}, fmt.Errorf("no available IP addresses in %s", a.pool)
+}
+
+// Assign 校验静态指定的地址，保留区间和隔离期内的地址允许静态指定
+func (a *ipAllocator) Assign(ip string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%w: invalid IP address %q", ErrAddressUnavailable, ip)
+	}
+	if !a.pool.Contains(addr) {
+		return netip.Addr{}, fmt.Errorf("%w: %s is outside the pool %s", ErrAddressUnavailable, addr, a.pool)
+	}
+	if a.fixed[addr] {
+		return netip.Addr{}, fmt.Errorf("%w: %s is the network, broadcast or server address", ErrAddressUnavailable, addr)
+	}
+	if a.used[addr] {
+		return netip.Addr{}, fmt.Errorf("%w: %s is already assigned", ErrAddressUnavailable, addr)
+	}
+	return addr, nil
+}
+
+func (a *ipAllocator) reservedRange(addr netip.Addr) (addrRange, bool) {
+	for _, r := range a.reserved {
+		if r.contains(addr) {
+			return r, true
+		}
+	}
+	return addrRange{}, false
+}
+
+// parseAddrRange 解析保留地址，支持单个地址、CIDR 和 "起始地址-结束地址"
+func parseAddrRange(entry string) (addrRange, error) {
+	entry = strings.TrimSpace(entry)
+	if from, to, ok := strings.Cut(entry, "-"); ok {
+		start, err1 := netip.ParseAddr(strings.TrimSpace(from))
+		end, err2 := netip.ParseAddr(strings.TrimSpace(to))
+		if err := errors.Join(err1, err2); err != nil {
+			return addrRange{}, fmt.Errorf("invalid reserved range %q: %w", entry, err)
+		}
+		if start.BitLen() != end.BitLen() || end.Less(start) {
+			return addrRange{}, fmt.Errorf("invalid reserved range %q", entry)
+		}
+		return addrRange{from: start, to: end}, nil
+	}
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return addrRange{}, fmt.Errorf("invalid reserved prefix %q: %w", entry, err)
+		}
+		prefix = prefix.Masked()
+		return addrRange{from: prefix.Addr(), to: lastAddr(prefix)}, nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return addrRange{}, fmt.Errorf("invalid reserved address %q: %w", entry, err)
+	}
+	return addrRange{from: addr, to: addr}, nil
+}
+
+// lastAddr 返回前缀中的最后一个地址
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// quarantine 解析地址隔离期，空表示释放的地址可以立即重用
+func (c ServerConfig) quarantine() (time.Duration, error) {
+	if c.IPQuarantine == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.IPQuarantine)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ip_quarantine %q: %w", c.IPQuarantine, err)
+	}
+	return d, nil
+}
+
+// usedIPs 返回所有接口上已分配的 IPv4 和 IPv6 地址
+func (um *UserManager) usedIPs() (map[netip.Addr]bool, error) {
+	var ips []string
+	err := um.db.Model(&User{}).Pluck("ip", &ips).Error
+	if err != nil {
+		return nil, err
+	}
+	var ipv6s []string
+	err = um.db.Model(&User{}).Where("ipv6 != ''").Pluck("ipv6", &ipv6s).Error
+	if err != nil {
+		return nil, err
+	}
+	return addrSet(append(ips, ipv6s...)), nil
+}
+
+// addrSet 将地址列表转换为集合，忽略无法解析的地址
+func addrSet(ips []string) map[netip.Addr]bool {
+	set := make(map[netip.Addr]bool, len(ips))
+	for _, ip := range ips {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			set[addr] = true
+		}
+	}
+	return set
+}
+
+// quarantinedIPs 清理当前接口上已过隔离期的记录，返回仍在隔离期内的地址。
+// 各接口的隔离期不同，不能清理其他接口的记录
+func (um *UserManager) quarantinedIPs(quarantine time.Duration) (map[netip.Addr]bool, error) {
+	cutoff := time.Now().Add(-quarantine)
+	err := um.db.Where("interface = ? AND released_at <= ?", um.iface, cutoff).Delete(&ReleasedIP{}).Error
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	if err := um.db.Model(&ReleasedIP{}).Where("interface = ?", um.iface).Pluck("ip", &ips).Error; err != nil {
+		return nil, err
+	}
+	return addrSet(ips), nil
+}
+
+// releaseIPs 记录被删除用户的地址
+func (um *UserManager) releaseIPs(users []User) error {
+	now := time.Now()
+	for _, user := range users {
+		for _, ip := range []string{user.IP, user.IPv6} {
+			if ip == "" {
+				continue
+			}
+			released := ReleasedIP{IP: ip, Interface: user.Interface, ReleasedAt: now}
+			err := um.db.Where(ReleasedIP{IP: ip}).Assign(ReleasedIP{Interface: user.Interface, ReleasedAt: now}).FirstOrCreate(&released).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// allocateIPs 为用户分配地址。user.IP、user.IPv6 非空时作为静态地址校验，否则自动分配；
+// 未配置 IPv6 地址池时不分配 IPv6 地址
+func (um *UserManager) allocateIPs(serverConfig ServerConfig, user *User) error {
+	quarantine, err := serverConfig.quarantine()
+	if err != nil {
+		return err
+	}
+	used, err := um.usedIPs()
+	if err != nil {
+		return err
+	}
+	quarantined, err := um.quarantinedIPs(quarantine)
+	if err != nil {
+		return err
+	}
+
+	v4, err := newIPAllocator(serverConfig.IPPool, []string{serverConfig.IP}, serverConfig.Reserved, used, quarantined)
+	if err != nil {
+		return err
+	}
+	user.IP, err = allocate(v4, user.IP)
+	if err != nil {
+		return err
+	}
+
+	if serverConfig.IPPoolV6 == "" {
+		if user.IPv6 != "" {
+			return fmt.Errorf("%w: interface has no IPv6 pool for %s", ErrAddressUnavailable, user.IPv6)
+		}
+		return nil
+	}
+	if err := validatePoolV6(serverConfig.IPPoolV6); err != nil {
+		return err
+	}
+	v6, err := newIPAllocator(serverConfig.IPPoolV6, []string{serverConfig.IPv6}, serverConfig.Reserved, used, quarantined)
+	if err != nil {
+		return err
+	}
+	user.IPv6, err = allocate(v6, user.IPv6)
+	return err
+}
+
+func allocate(a *ipAllocator, static string) (string, error) {
+	var addr netip.Addr
+	var err error
+	if static != "" {
+		addr, err = a.Assign(static)
+	} else {
+		addr, err = a.Next()
+	}
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// validatePoolV6 检查 IPv6 地址池
+func validatePoolV6(cidr string) error {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid IPv6 pool: %w", err)
+	}
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return fmt.Errorf("IPv6 pool %s is not an IPv6 prefix", cidr)
+	}
+	return nil
+}
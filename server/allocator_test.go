@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestIPAllocatorNext(t *testing.T) {
+	tests := []struct {
+		pool     string
+		server   string
+		reserved []string
+		used     []string
+		want     string
+	}{
+		{"100.10.10.0/24", "100.10.10.1/24", nil, nil, "100.10.10.2"},
+		{"100.10.10.0/24", "100.10.10.1/24", nil, []string{"100.10.10.2", "100.10.10.3"}, "100.10.10.4"},
+		{"100.10.10.0/24", "100.10.10.1/24", []string{"100.10.10.2-100.10.10.9"}, nil, "100.10.10.10"},
+		{"100.10.10.0/24", "100.10.10.1/24", []string{"100.10.10.0/28", "100.10.10.16"}, nil, "100.10.10.17"},
+		{"100.10.10.0/30", "100.10.10.1/30", nil, []string{"100.10.10.2"}, ""},
+		{"fd00:10::/64", "fd00:10::1/64", nil, nil, "fd00:10::2"},
+		{"fd00:10::/64", "fd00:10::1/64", []string{"fd00:10::/120"}, nil, "fd00:10::100"},
+	}
+	for _, tt := range tests {
+		a, err := newIPAllocator(tt.pool, []string{tt.server}, tt.reserved, addrSet(tt.used), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := a.Next()
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("Next() in %s = %s, want error", tt.pool, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != tt.want {
+			t.Errorf("Next() in %s = %s, %v, want %s", tt.pool, got, err, tt.want)
+		}
+	}
+}
+
+func TestIPAllocatorAssign(t *testing.T) {
+	used := addrSet([]string{"100.10.10.5"})
+	a, err := newIPAllocator("100.10.10.0/24", []string{"100.10.10.1/24"}, []string{"100.10.10.200-100.10.10.254"}, used, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := a.Assign("100.10.10.200"); err != nil || got.String() != "100.10.10.200" {
+		t.Errorf("Assign(reserved) = %s, %v", got, err)
+	}
+	for _, ip := range []string{"100.10.10.0", "100.10.10.1", "100.10.10.255", "100.10.10.5", "100.10.11.2", "bogus"} {
+		if _, err := a.Assign(ip); !errors.Is(err, ErrAddressUnavailable) {
+			t.Errorf("Assign(%s) = %v, want ErrAddressUnavailable", ip, err)
+		}
+	}
+}
+
+func TestAddUserQuarantine(t *testing.T) {
+	um := newTestUserManager(t)
+
+	serverConfig := testServerConfig
+	serverConfig.IPQuarantine = "1h"
+	if err := um.AddUser(serverConfig, &User{UserID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	bob := &User{UserID: "bob"}
+	if err := um.AddUser(serverConfig, bob); err != nil {
+		t.Fatal(err)
+	}
+	if bob.IP != "100.10.10.3" {
+		t.Errorf("bob got %s, want 100.10.10.3 while 100.10.10.2 is quarantined", bob.IP)
+	}
+
+	// 隔离期内的地址仍然可以静态指定
+	carol := &User{UserID: "carol", IP: "100.10.10.2"}
+	if err := um.AddUser(serverConfig, carol); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := um.AddUser(serverConfig, &User{UserID: "dave", IP: "100.10.10.3"}); !errors.Is(err, ErrAddressUnavailable) {
+		t.Errorf("assigning bob's address returned %v, want ErrAddressUnavailable", err)
+	}
+
+	// 不配置隔离期时释放的地址立即重用
+	if err := um.DeleteUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	erin := &User{UserID: "erin"}
+	if err := um.AddUser(testServerConfig, erin); err != nil {
+		t.Fatal(err)
+	}
+	if erin.IP != "100.10.10.3" {
+		t.Errorf("erin got %s, want the released 100.10.10.3", erin.IP)
+	}
+
+	// 没有隔离期的接口分配地址时不会清理其他接口的隔离记录
+	if err := um.DeleteUser("erin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.CreateInterface(&Interface{Name: "wg1", Port: 51821, IP: "100.20.20.1/24", IPPool: "100.20.20.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	wg1 := um.ForInterface("wg1")
+	wg1Config, err := wg1.InterfaceConfig(&serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wg1.AddUser(*wg1Config, &User{UserID: "site-a"}); err != nil {
+		t.Fatal(err)
+	}
+	frank := &User{UserID: "frank"}
+	if err := um.AddUser(serverConfig, frank); err != nil {
+		t.Fatal(err)
+	}
+	if frank.IP != "100.10.10.4" {
+		t.Errorf("frank got %s, want 100.10.10.4 while erin's 100.10.10.3 is quarantined on wg0", frank.IP)
+	}
+}
+
+func BenchmarkIPAllocatorNext(b *testing.B) {
+	used := make(map[netip.Addr]bool)
+	addr := netip.MustParseAddr("100.64.0.2")
+	for i := 0; i < 50000; i++ {
+		used[addr] = true
+		addr = addr.Next()
+	}
+	a, err := newIPAllocator("100.64.0.0/10", []string{"100.64.0.1/10"}, nil, used, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := a.Next(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
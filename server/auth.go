@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// tokenPrefix 便于在日志或配置中识别 API 令牌
+const tokenPrefix = "wgm_"
+
+var errInvalidToken = errors.New("invalid API token")
+
+// hashToken 令牌只以 SHA-256 哈希保存
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseRole 解析角色名称
+func ParseRole(name string) (Role, error) {
+	switch role := Role(name); role {
+	case RoleAdmin, RoleOperator, RoleSelf:
+		return role, nil
+	}
+	return "", fmt.Errorf("unknown role %q, must be one of admin, operator, self", name)
+}
+
+// CreateToken 创建新的 API 令牌，明文只在此处返回一次。
+// RoleSelf 令牌必须绑定当前接口上一个已存在的用户
+func (um *UserManager) CreateToken(name string, role Role, userID string) (string, *APIToken, error) {
+	if name == "" {
+		return "", nil, errors.New("token name is required")
+	}
+	if role == RoleSelf {
+		if userID == "" {
+			return "", nil, errors.New("a self role token must be bound to a user")
+		}
+		if _, err := um.GetUser(userID); err != nil {
+			return "", nil, fmt.Errorf("user %s: %w", userID, err)
+		}
+	} else {
+		userID = ""
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	apiToken := &APIToken{Name: name, TokenHash: hashToken(token), Role: role, UserID: userID}
+	if role == RoleSelf {
+		apiToken.Interface = um.iface
+	}
+	if err := um.db.Create(apiToken).Error; err != nil {
+		return "", nil, err
+	}
+	return token, apiToken, nil
+}
+
+func (um *UserManager) ListTokens() ([]APIToken, error) {
+	var tokens []APIToken
+	err := um.db.Order("id").Find(&tokens).Error
+	return tokens, err
+}
+
+// RevokeToken 删除指定名称的令牌
+func (um *UserManager) RevokeToken(name string) error {
+	result := um.db.Where("name = ?", name).Delete(&APIToken{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// AuthenticateToken 校验令牌并记录最近使用时间
+func (um *UserManager) AuthenticateToken(token string) (*APIToken, error) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return nil, errInvalidToken
+	}
+	var apiToken APIToken
+	err := um.db.Where("token_hash = ?", hashToken(token)).First(&apiToken).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	apiToken.LastUsedAt = &now
+	um.db.Model(&apiToken).Update("last_used_at", now)
+	return &apiToken, nil
+}
+
+// authMiddleware 要求请求携带 Authorization: Bearer <token>
+func authMiddleware(um *UserManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, Response{Message: "Unauthorized", Data: gin.H{"error": "API token is required"}})
+			return
+		}
+
+		apiToken, err := um.AuthenticateToken(strings.TrimSpace(token))
+		if errors.Is(err, errInvalidToken) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, Response{Message: "Unauthorized", Data: gin.H{"error": "Invalid API token"}})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+			return
+		}
+
+		c.Set("token", apiToken)
+		c.Next()
+	}
+}
+
+// tokenFromContext 返回请求使用的令牌，未启用认证时为 nil
+func tokenFromContext(c *gin.Context) *APIToken {
+	value, ok := c.Get("token")
+	if !ok {
+		return nil
+	}
+	token, _ := value.(*APIToken)
+	return token
+}
+
+// forbid 拒绝请求并记录日志
+func forbid(c *gin.Context, reason string) {
+	token := tokenFromContext(c)
+	log.Printf("forbidden: token %q (role %s) %s %s: %s", token.Name, token.Role, c.Request.Method, c.Request.URL.Path, reason)
+	c.AbortWithStatusJSON(http.StatusForbidden, Response{Message: "Forbidden", Data: gin.H{"error": reason}})
+}
+
+// requireRole 只允许指定角色访问，未启用认证时放行
+func requireRole(roles ...Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := tokenFromContext(c)
+		if token == nil {
+			c.Next()
+			return
+		}
+		for _, role := range roles {
+			if token.Role == role {
+				c.Next()
+				return
+			}
+		}
+		forbid(c, fmt.Sprintf("role %s is not allowed to call this endpoint", token.Role))
+	}
+}
+
+// canAccessUser RoleSelf 只能访问绑定的用户，不同接口上可以有同名用户
+func canAccessUser(c *gin.Context, iface, userID string) bool {
+	token := tokenFromContext(c)
+	if token == nil || token.Role != RoleSelf {
+		return true
+	}
+	if token.UserID == userID && (token.Interface == "" || token.Interface == iface) {
+		return true
+	}
+	forbid(c, "self role tokens can only access their own user")
+	return false
+}
+
+// canModifyUser admin 可以删除或修改任何用户，operator 只能删除或修改自己添加的用户，
+// action 用于错误信息，如 delete
+func canModifyUser(c *gin.Context, user *User, action string) bool {
+	token := tokenFromContext(c)
+	if token == nil || token.Role == RoleAdmin {
+		return true
+	}
+	if token.Role == RoleOperator && user.CreatedBy == token.Name {
+		return true
+	}
+	forbid(c, fmt.Sprintf("operators can only %s users they added", action))
+	return false
+}
+
+// canReadUserConfig 客户端配置包含私钥，operator 只能读取自己添加的用户的配置，
+// RoleSelf 由 canAccessUser 限定为绑定的用户
+func canReadUserConfig(c *gin.Context, user *User) bool {
+	token := tokenFromContext(c)
+	if token == nil || token.Role != RoleOperator {
+		return true
+	}
+	return canModifyUser(c, user, "read the configs of")
+}
+
+// createdBy 返回当前请求的令牌名称，用于记录用户由谁添加
+func createdBy(c *gin.Context) string {
+	if token := tokenFromContext(c); token != nil {
+		return token.Name
+	}
+	return ""
+}
+
+// isLoopbackAddr 判断监听地址是否只绑定本机
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
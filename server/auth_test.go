@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	um := newTestUserManager(t)
+	token, _, err := um.CreateToken("ci", RoleAdmin, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(authMiddleware(um))
+	r.POST("/ping", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	cases := []struct {
+		header string
+		want   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wgm_wrong", http.StatusUnauthorized},
+		{"Bearer " + token, http.StatusOK},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/ping", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("Authorization %q: got %d, want %d", tc.header, w.Code, tc.want)
+		}
+	}
+
+	if err := um.RevokeToken("ci"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.AuthenticateToken(token); err == nil {
+		t.Error("revoked token still authenticates")
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		"localhost:8080": true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"10.0.0.1:8080":  false,
+	} {
+		if got := isLoopbackAddr(addr); got != want {
+			t.Errorf("isLoopbackAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestRoleAccess(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	um := newTestUserManager(t)
+	if err := um.AddUser(testServerConfig, &User{UserID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := um.CreateToken("nobody", RoleSelf, ""); err == nil {
+		t.Error("expected self role token without a user to be rejected")
+	}
+	operatorToken, _, err := um.CreateToken("ops", RoleOperator, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfToken, _, err := um.CreateToken("alice", RoleSelf, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(authMiddleware(um))
+	r.POST("/setup", requireRole(RoleAdmin), func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.POST("/user/:id", requireRole(RoleAdmin, RoleOperator, RoleSelf), func(c *gin.Context) {
+		if canAccessUser(c, um.Interface(), c.Param("id")) {
+			c.Status(http.StatusOK)
+		}
+	})
+
+	cases := []struct {
+		token string
+		path  string
+		want  int
+	}{
+		{operatorToken, "/setup", http.StatusForbidden},
+		{operatorToken, "/user/bob", http.StatusOK},
+		{selfToken, "/setup", http.StatusForbidden},
+		{selfToken, "/user/alice", http.StatusOK},
+		{selfToken, "/user/bob", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.path, w.Code, tc.want)
+		}
+	}
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"gorm.io/gorm"
 )
 
 func Setup() *cobra.Command {
@@ -18,13 +24,20 @@ func Setup() *cobra.Command {
 		Use:   "setup",
 		Short: "Setup VPN server configuration",
 		Run: func(cmd *cobra.Command, args []string) {
-			userManager, err := NewUserManager("./users.db")
+			userManager, err := openUserManager(cmd)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			// 从 YAML 文件加载服务器配置
-			serverConfig, err := LoadServerConfig("server.yaml")
+			all, _ := cmd.Flags().GetBool("all")
+			if all {
+				outputDir, _ := cmd.Flags().GetString("output-dir")
+				setupAllInterfaces(cmd, userManager, outputDir)
+				return
+			}
+
+			// 加载 --interface 选择的接口配置
+			serverConfig, err := loadServerConfig(cmd, userManager)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -36,26 +49,52 @@ func Setup() *cobra.Command {
 			fmt.Println(config)
 
 			// 将配置写入文件
-			configPath := "./wg.conf"
-			err = os.WriteFile(configPath, []byte(config), 0644)
+			output, _ := cmd.Flags().GetString("output")
+			err = os.WriteFile(output, []byte(config), 0644)
 			if err != nil {
 				log.Fatal(err)
 			}
 		},
 	}
+	setupCmd.Flags().String("output", "./wg.conf", "Where to write the generated server config")
+	setupCmd.Flags().Bool("all", false, "Render one <interface>.conf per interface into --output-dir")
+	setupCmd.Flags().String("output-dir", ".", "Directory used by --all")
 	return setupCmd
 }
+
+// setupAllInterfaces 为每个接口生成 <name>.conf
+func setupAllInterfaces(cmd *cobra.Command, userManager *UserManager, outputDir string) {
+	fileConfig, err := LoadServerConfig(configPath(cmd))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatal(err)
+	}
+	configs, err := userManager.AllInterfaceConfigs(fileConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, serverConfig := range configs {
+		config, err := userManager.ForInterface(serverConfig.Name).GenerateServerConfig(serverConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		output := filepath.Join(outputDir, serverConfig.Name+".conf")
+		if err := os.WriteFile(output, []byte(config), 0644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Wrote %s\n", output)
+	}
+}
 func Add() *cobra.Command {
 	var addUserCmd = &cobra.Command{
 		Use:   "adduser",
 		Short: "Add a new user to VPN",
 		Run: func(cmd *cobra.Command, args []string) {
-			userManager, err := NewUserManager("./users.db")
+			userManager, err := openUserManager(cmd)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			serverConfig, err := LoadServerConfig("server.yaml")
+			serverConfig, err := loadServerConfig(cmd, userManager)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -66,230 +105,1505 @@ func Add() *cobra.Command {
 			}
 			allowedIPs, _ := cmd.Flags().GetString("allowedips")
 			advertiseRoutes, _ := cmd.Flags().GetString("advertise-routes")
-			acceptRoutes, _ := cmd.Flags().GetBool("accept-routes")
+			acceptRoutes, _ := cmd.Flags().GetStringSlice("accept-routes")
+			acceptAllRoutes, _ := cmd.Flags().GetBool("accept-all-routes")
 			preup, _ := cmd.Flags().GetString("preup")
 			postup, _ := cmd.Flags().GetString("postup")
 			predown, _ := cmd.Flags().GetString("predown")
 			postdown, _ := cmd.Flags().GetString("postdown")
+			groups, _ := cmd.Flags().GetStringSlice("group")
+			expires, _ := cmd.Flags().GetString("expires")
+			withPSK, _ := cmd.Flags().GetBool("psk")
+			publicKey, _ := cmd.Flags().GetString("public-key")
+			ip, _ := cmd.Flags().GetString("ip")
+			ipv6, _ := cmd.Flags().GetString("ipv6")
 			endpoint := fmt.Sprintf("%s:%d", serverConfig.ServerIP, serverConfig.Port)
 			persistentKeepalive := 25
 
-			var acceptedRoutes string
-			if acceptRoutes {
-				var routes []string
-
-				availableRoutes, err := userManager.GetAllRoutes()
+			// 只写 --accept-routes 而不带值时交互式选择，值写在后面时作为位置参数出现
+			if len(acceptRoutes) == 1 && acceptRoutes[0] == promptRoutes {
+				acceptRoutes = args
+				if len(acceptRoutes) == 0 {
+					acceptRoutes = promptAcceptRoutes(userManager)
+				}
+			}
+			var acceptedRoutes []Route
+			if len(acceptRoutes) > 0 {
+				acceptedRoutes, err = userManager.SelectRoutes(acceptRoutes)
 				if err != nil {
 					log.Fatal(err)
 				}
+			}
 
-				// 使用 survey 进行交互式选择
-				prompt := &survey.MultiSelect{
-					Message: "Select routes to accept:",
-					Options: availableRoutes,
+			for _, group := range groups {
+				if _, err := userManager.findGroup(group); err != nil {
+					log.Fatal(err)
 				}
-				err = survey.AskOne(prompt, &routes)
+			}
+			expiresAt, err := parseExpiry(expires, time.Now())
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			var presharedKey string
+			if withPSK {
+				presharedKey, err = userManager.NewPresharedKey()
 				if err != nil {
 					log.Fatal(err)
 				}
-
-				acceptedRoutes = fmt.Sprintf("%s", strings.Join(routes, ","))
 			}
 
-			err = userManager.AddUser(&User{
+			device := applyDevice(cmd)
+			userManager = userManager.WithDevice(device)
+
+			err = userManager.AddUser(*serverConfig, &User{
 				UserID:              userID,
+				IP:                  ip,
+				IPv6:                ipv6,
 				AllowedIPs:          allowedIPs,
-				AdvertiseRoutes:     advertiseRoutes,
+				AdvertisedRoutes:    newRoutes(advertiseRoutes),
 				Endpoint:            endpoint,
-				AcceptRoutes:        acceptedRoutes,
+				AcceptedRoutes:      acceptedRoutes,
+				AcceptAllRoutes:     acceptAllRoutes,
+				ExpiresAt:           expiresAt,
 				PersistentKeepalive: persistentKeepalive,
+				PresharedKey:        presharedKey,
+				PublicKey:           publicKey,
 				PreUp:               preup,
 				PostUp:              postup,
 				PreDown:             predown,
 				PostDown:            postdown,
 			})
-			if err != nil {
-				log.Fatal(err)
+			checkApplyError(err)
+			for _, group := range groups {
+				if err := userManager.AddGroupMembers(group, []string{userID}); err != nil {
+					log.Fatal(err)
+				}
 			}
 
-			users, err := userManager.GetAllUsers()
+			config, err := userManager.IssueUserConfig(*serverConfig, userID)
 			if err != nil {
 				log.Fatal(err)
 			}
-			for _, user := range users {
-				if user.UserID == userID {
-					fmt.Printf("%s", generateUserConfig(*serverConfig, user))
-				}
-			}
+			fmt.Printf("%s", config)
+			reportDevice(userManager, device)
 		},
 	}
 	addUserCmd.Flags().String("id", "", "User ID")
+	addUserCmd.Flags().StringSlice("group", nil, "Groups to add the user to, they must exist")
+	addUserCmd.Flags().String("expires", "", "Remove access after a period (30d, 2w, 12h) or at a date (2006-01-02)")
+	addUserCmd.Flags().String("ip", "", "Static IPv4 address from the pool, reserved addresses are allowed (default: next free address)")
+	addUserCmd.Flags().String("ipv6", "", "Static IPv6 address from the IPv6 pool (default: next free address)")
 	addUserCmd.Flags().String("allowedips", "", "For client side, which traffic can be passed to the server")
 	addUserCmd.Flags().String("advertise-routes", "", "Advertise a route to the server, so that other client can connect to it")
-	addUserCmd.Flags().Bool("accept-routes", false, "Accept a route to the server, so that other client can connect to it")
+	addUserCmd.Flags().StringSlice("accept-routes", nil, "Routes to accept, as CIDRs or IDs of the users advertising them; without a value, select interactively")
+	addUserCmd.Flags().Lookup("accept-routes").NoOptDefVal = promptRoutes
+	addUserCmd.Flags().Bool("accept-all-routes", false, "Accept every enabled route on the interface, including routes advertised later")
+	addUserCmd.MarkFlagsMutuallyExclusive("accept-routes", "accept-all-routes")
 	// PostUp = sysctl -w net.ipv4.ip_forward=1; iptables -t nat -A POSTROUTING -o wg0 -j MASQUERADE
 	// PostDown = sysctl -w net.ipv4.ip_forward=0; iptables -t nat -D POSTROUTING -o wg0 -j MASQUERADE
 	addUserCmd.Flags().String("preup", "", "Pre up")
 	addUserCmd.Flags().String("postup", "", "Post up")
 	addUserCmd.Flags().String("predown", "", "Pre down")
 	addUserCmd.Flags().String("postdown", "", "Post down")
+	addUserCmd.Flags().Bool("psk", false, "Generate a preshared key for the peer")
+	addUserCmd.Flags().String("public-key", "", "Use a client-generated public key, the server will not hold the private key")
+	addApplyFlags(addUserCmd)
 
 	return addUserCmd
 }
+
+// promptRoutes 是 --accept-routes 不带值时的取值
+const promptRoutes = "?"
+
+// promptAcceptRoutes 交互式选择要接受的路由，标准输入不是终端时直接退出而不是等待输入
+func promptAcceptRoutes(userManager *UserManager) []string {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		log.Fatal("--accept-routes without a value needs a terminal, pass --accept-routes=<cidr|user>,... or --accept-all-routes instead")
+	}
+
+	availableRoutes, err := userManager.GetAllRoutes()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(availableRoutes) == 0 {
+		log.Fatal("No routes are advertised on this interface")
+	}
+
+	// 使用 survey 进行交互式选择
+	var routes []string
+	prompt := &survey.MultiSelect{
+		Message: "Select routes to accept:",
+		Options: availableRoutes,
+	}
+	if err := survey.AskOne(prompt, &routes); err != nil {
+		log.Fatal(err)
+	}
+	return routes
+}
+
 func Delete() *cobra.Command {
 	var deleteUserCmd = &cobra.Command{
 		Use:   "deluser",
 		Short: "Delete a user from VPN",
 		Run: func(cmd *cobra.Command, args []string) {
-			userManager, err := NewUserManager("./users.db")
+			userManager, err := openUserManager(cmd)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			userID, _ := cmd.Flags().GetString("id")
-			if userID == "" {
-				log.Fatal("You must provide a user ID")
+			userIDs := selectUserIDs(cmd, userManager)
+			device := applyDevice(cmd)
+			userManager = userManager.WithDevice(device)
+
+			for _, userID := range userIDs {
+				err = userManager.DeleteUser(userID)
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					log.Fatalf("User %s not found on %s", userID, userManager.Interface())
+				}
+				checkApplyError(err)
+				fmt.Printf("User %s deleted successfully\n", userID)
 			}
-			err = userManager.DeleteUser(userID)
+			reportDevice(userManager, device)
+		},
+	}
+	deleteUserCmd.Flags().String("id", "", "User ID")
+	addGroupFlag(deleteUserCmd, "Delete every member of the group")
+	addApplyFlags(deleteUserCmd)
+	return deleteUserCmd
+}
+
+func RotatePSK() *cobra.Command {
+	var rotatePSKCmd = &cobra.Command{
+		Use:   "rotatepsk",
+		Short: "Generate a new preshared key for one or all users",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			fmt.Printf("User %s deleted successfully\n", userID)
+			var userIDs []string
+			if all, _ := cmd.Flags().GetBool("all"); all {
+				// --all 只轮换已有预共享密钥的用户，需要新增时使用 --id 或 --group
+				users, err := userManager.GetAllUsers()
+				if err != nil {
+					log.Fatal(err)
+				}
+				for _, user := range users {
+					if user.PresharedKey == "" {
+						fmt.Printf("Skipping user %s without a preshared key\n", user.UserID)
+						continue
+					}
+					userIDs = append(userIDs, user.UserID)
+				}
+			} else {
+				userIDs = selectUserIDs(cmd, userManager)
+			}
+
+			device := applyDevice(cmd)
+			userManager = userManager.WithDevice(device)
+
+			for _, id := range userIDs {
+				err = userManager.RotatePresharedKey(id)
+				checkApplyError(err)
+				fmt.Printf("Preshared key rotated for user %s\n", id)
+			}
+			fmt.Println("Run setup to refresh the server config and redistribute the client configs")
+			reportDevice(userManager, device)
 		},
 	}
-	deleteUserCmd.Flags().String("id", "", "User ID")
-	return deleteUserCmd
+	rotatePSKCmd.Flags().String("id", "", "User ID")
+	rotatePSKCmd.Flags().Bool("all", false, "Rotate the preshared key of every user that already has one")
+	addGroupFlag(rotatePSKCmd, "Rotate the preshared key of every member of the group")
+	rotatePSKCmd.MarkFlagsMutuallyExclusive("id", "group", "all")
+	addApplyFlags(rotatePSKCmd)
+	return rotatePSKCmd
 }
 
-func Get() *cobra.Command {
-	var getUserCmd = &cobra.Command{
-		Use:   "getuser",
-		Short: "Get a user from VPN",
+func RotateKey() *cobra.Command {
+	var rotateKeyCmd = &cobra.Command{
+		Use:   "rotatekey",
+		Short: "Issue a new keypair for a user, keeping its IP, routes and hooks",
 		Run: func(cmd *cobra.Command, args []string) {
-			userManager, err := NewUserManager("./users.db")
+			userManager, err := openUserManager(cmd)
 			if err != nil {
 				log.Fatal(err)
 			}
-			userID, _ := cmd.Flags().GetString("id")
-			if userID == "" {
-				log.Fatal("User ID is required")
-			}
-			users, err := userManager.GetAllUsers()
+			serverConfig, err := loadServerConfig(cmd, userManager)
 			if err != nil {
-				return
+				log.Fatal(err)
+			}
+
+			userIDs := selectUserIDs(cmd, userManager)
+			publicKey, _ := cmd.Flags().GetString("public-key")
+			if group, _ := cmd.Flags().GetString("group"); publicKey != "" && group != "" {
+				log.Fatal("--public-key cannot be used with --group")
 			}
-			serverConfig, err := LoadServerConfig("server.yaml")
+
+			device := applyDevice(cmd)
+			userManager = userManager.WithDevice(device)
+
+			for _, userID := range userIDs {
+				err = userManager.RotateUserKey(userID, publicKey)
+				checkApplyError(err)
+			}
+
+			outputDir, _ := cmd.Flags().GetString("output-dir")
+			writeUserConfigs(userManager, *serverConfig, userIDs, outputDir, true)
+			reportDevice(userManager, device)
+		},
+	}
+	rotateKeyCmd.Flags().String("id", "", "User ID")
+	rotateKeyCmd.Flags().String("public-key", "", "Use a client-generated public key instead of issuing a keypair")
+	addGroupFlag(rotateKeyCmd, "Rotate the keys of every member of the group")
+	rotateKeyCmd.Flags().String("output-dir", "", "Write one <id>.conf per user instead of printing the configs")
+	addApplyFlags(rotateKeyCmd)
+	return rotateKeyCmd
+}
+
+func RotateServerKey() *cobra.Command {
+	var rotateServerKeyCmd = &cobra.Command{
+		Use:   "rotate-server-key",
+		Short: "Issue a new server keypair and update server.yaml",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
 			if err != nil {
 				log.Fatal(err)
 			}
-			for _, user := range users {
-				if user.UserID == userID {
-					fmt.Printf("%s", generateUserConfig(*serverConfig, user))
+
+			device := applyDevice(cmd)
+			userManager = userManager.WithDevice(device)
+
+			users, err := userManager.RotateServerKey(configPath(cmd))
+			checkApplyError(err)
+
+			fmt.Println("Server key rotated, run setup to refresh the server config")
+			if len(users) > 0 {
+				fmt.Println("The following client configs must be redistributed:")
+				for _, user := range users {
+					fmt.Printf("  %s\t%s\n", user.UserID, user.IP)
 				}
 			}
 		},
 	}
-	getUserCmd.Flags().String("id", "", "User ID")
-	return getUserCmd
+	addApplyFlags(rotateServerKeyCmd)
+	return rotateServerKeyCmd
 }
-func GetAllUsers() *cobra.Command {
-	var getAllUsersCmd = &cobra.Command{
-		Use:   "getall",
-		Short: "Get all users from VPN",
+
+func MigrateEncrypt() *cobra.Command {
+	var migrateEncryptCmd = &cobra.Command{
+		Use:   "migrate-encrypt",
+		Short: "Encrypt plaintext private keys in users.db and server.yaml with the master key",
 		Run: func(cmd *cobra.Command, args []string) {
-			userManager, err := NewUserManager("./users.db")
+			userManager, err := openUserManager(cmd)
 			if err != nil {
 				log.Fatal(err)
 			}
-			users, err := userManager.GetAllUsers()
+			count, err := userManager.MigrateEncrypt(configPath(cmd))
 			if err != nil {
 				log.Fatal(err)
 			}
+			fmt.Printf("Encrypted keys of %d users\n", count)
+		},
+	}
+	return migrateEncryptCmd
+}
 
-			w := tabwriter.NewWriter(os.Stdout, 15, 20, 0, ' ', tabwriter.TabIndent)
-			fmt.Fprintf(w, "ID\tIP\n")
+func Token() *cobra.Command {
+	tokenCmd := &cobra.Command{
+		Use:   "token",
+		Short: "Manage API tokens",
+	}
 
-			for _, user := range users {
-				fmt.Fprintf(w, "%s\t%s\t\n", user.UserID, user.IP)
+	createCmd := &cobra.Command{
+		Use:   "create",
+		Short: "Create an API token",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			name, _ := cmd.Flags().GetString("name")
+			if name == "" {
+				log.Fatal("You must provide a token name")
+			}
+			// 不提供默认角色，避免误建 admin 令牌
+			roleName, _ := cmd.Flags().GetString("role")
+			if roleName == "" {
+				log.Fatal("You must provide a token role: admin, operator or self")
+			}
+			role, err := ParseRole(roleName)
+			if err != nil {
+				log.Fatal(err)
+			}
+			userID, _ := cmd.Flags().GetString("user")
+			token, _, err := userManager.CreateToken(name, role, userID)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintln(os.Stderr, "Store this token now, it cannot be shown again:")
+			fmt.Println(token)
+		},
+	}
+	createCmd.Flags().String("name", "", "Token name")
+	createCmd.Flags().String("role", "", "Token role: admin, operator or self (required)")
+	createCmd.Flags().String("user", "", "User ID bound to a self role token")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List API tokens",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			tokens, err := userManager.ListTokens()
+			if err != nil {
+				log.Fatal(err)
 			}
 
+			w := tabwriter.NewWriter(os.Stdout, 15, 20, 0, ' ', tabwriter.TabIndent)
+			fmt.Fprintf(w, "NAME\tROLE\tUSER\tCREATED\tLAST USED\n")
+			for _, token := range tokens {
+				lastUsed := "never"
+				if token.LastUsedAt != nil {
+					lastUsed = token.LastUsedAt.Format("2006-01-02 15:04:05")
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t\n", token.Name, token.Role, token.UserID, token.CreatedAt.Format("2006-01-02 15:04:05"), lastUsed)
+			}
 			w.Flush()
 		},
 	}
-	return getAllUsersCmd
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke",
+		Short: "Revoke an API token",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			name, _ := cmd.Flags().GetString("name")
+			if name == "" {
+				log.Fatal("You must provide a token name")
+			}
+			if err := userManager.RevokeToken(name); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Token %s revoked\n", name)
+		},
+	}
+	revokeCmd.Flags().String("name", "", "Token name")
+
+	tokenCmd.AddCommand(createCmd, listCmd, revokeCmd)
+	return tokenCmd
 }
 
-func UpdateEndpoints() *cobra.Command {
-	var updateEndpointsCmd = &cobra.Command{
-		Use:   "updateendpoints",
-		Short: "Update user endpoints",
+func InterfaceCmd() *cobra.Command {
+	interfaceCmd := &cobra.Command{
+		Use:   "interface",
+		Short: "Manage WireGuard interfaces stored in the database",
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add",
+		Short: "Add an interface, a keypair is generated for it",
 		Run: func(cmd *cobra.Command, args []string) {
-			userManager, err := NewUserManager("./users.db")
+			userManager, err := NewUserManager(dbPath(cmd))
 			if err != nil {
 				log.Fatal(err)
 			}
-			serverConfig, err := LoadServerConfig("server.yaml")
+			iface := &Interface{}
+			iface.Name, _ = cmd.Flags().GetString("name")
+			iface.ServerIP, _ = cmd.Flags().GetString("server-ip")
+			iface.Port, _ = cmd.Flags().GetInt("port")
+			iface.IP, _ = cmd.Flags().GetString("ip")
+			iface.IPPool, _ = cmd.Flags().GetString("ip-pool")
+			iface.IPv6, _ = cmd.Flags().GetString("ip-v6")
+			iface.IPPoolV6, _ = cmd.Flags().GetString("ip-pool-v6")
+			reserved, _ := cmd.Flags().GetStringSlice("reserved")
+			iface.Reserved = strings.Join(reserved, ",")
+			iface.IPQuarantine, _ = cmd.Flags().GetString("ip-quarantine")
+			iface.DNS, _ = cmd.Flags().GetString("dns")
+			iface.Table, _ = cmd.Flags().GetString("table")
+			iface.MTU, _ = cmd.Flags().GetInt("mtu")
+			iface.PreUp, _ = cmd.Flags().GetString("preup")
+			iface.PostUp, _ = cmd.Flags().GetString("postup")
+			iface.PreDown, _ = cmd.Flags().GetString("predown")
+			iface.PostDown, _ = cmd.Flags().GetString("postdown")
+			if err := userManager.CreateInterface(iface); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Interface %s added, public key %s\n", iface.Name, iface.PublicKey)
+		},
+	}
+	addCmd.Flags().String("name", "", "Interface name, e.g. wg1")
+	addCmd.Flags().String("server-ip", "", "Public address clients use as endpoint")
+	addCmd.Flags().Int("port", 0, "Listen port")
+	addCmd.Flags().String("ip", "", "Interface address, e.g. 100.20.20.1/24")
+	addCmd.Flags().String("ip-pool", "", "Pool client addresses are allocated from, e.g. 100.20.20.0/24")
+	addCmd.Flags().String("ip-v6", "", "Optional interface IPv6 address, e.g. fd00:20::1/64")
+	addCmd.Flags().String("ip-pool-v6", "", "Optional IPv6 pool, every user also gets an address from it")
+	addCmd.Flags().StringSlice("reserved", nil, "Addresses, CIDRs or a-b ranges excluded from automatic allocation")
+	addCmd.Flags().String("ip-quarantine", "", "Do not reuse released addresses within this period, e.g. 168h (default: reuse immediately)")
+	addCmd.Flags().String("dns", "", "DNS")
+	addCmd.Flags().String("table", "", "Table")
+	addCmd.Flags().Int("mtu", 0, "MTU")
+	addCmd.Flags().String("preup", "", "Pre up")
+	addCmd.Flags().String("postup", "", "Post up")
+	addCmd.Flags().String("predown", "", "Pre down")
+	addCmd.Flags().String("postdown", "", "Post down")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List interfaces",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := NewUserManager(dbPath(cmd))
 			if err != nil {
 				log.Fatal(err)
 			}
-			err = userManager.UpdateUserEndpoints(*serverConfig)
+			fileConfig, err := LoadServerConfig(configPath(cmd))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Fatal(err)
+			}
+			configs, err := userManager.AllInterfaceConfigs(fileConfig)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			fmt.Println("User endpoints updated successfully")
+			w := tabwriter.NewWriter(os.Stdout, 15, 20, 0, ' ', tabwriter.TabIndent)
+			fmt.Fprintf(w, "NAME\tPORT\tADDRESS\tPOOL\tIPV6 POOL\n")
+			for _, config := range configs {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t\n", config.Name, config.Port, config.IP, config.IPPool, config.IPPoolV6)
+			}
+			w.Flush()
 		},
 	}
-	return updateEndpointsCmd
+
+	removeCmd := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove an interface without users",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := NewUserManager(dbPath(cmd))
+			if err != nil {
+				log.Fatal(err)
+			}
+			name, _ := cmd.Flags().GetString("name")
+			if name == "" {
+				log.Fatal("You must provide an interface name")
+			}
+			if err := userManager.DeleteInterface(name); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Interface %s removed\n", name)
+		},
+	}
+	removeCmd.Flags().String("name", "", "Interface name")
+
+	interfaceCmd.AddCommand(addCmd, listCmd, removeCmd)
+	return interfaceCmd
 }
 
-func Info() *cobra.Command {
-	var updateEndpointsCmd = &cobra.Command{
-		Use:   "info",
-		Short: "Get information about the endpoints",
+func RouteCmd() *cobra.Command {
+	routeCmd := &cobra.Command{
+		Use:   "route",
+		Short: "Manage routes advertised and accepted by users",
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add",
+		Short: "Advertise a route from a user",
 		Run: func(cmd *cobra.Command, args []string) {
-			userManager, err := NewUserManager("./users.db")
+			userManager, err := openUserManager(cmd)
 			if err != nil {
 				log.Fatal(err)
 			}
-			info, err := userManager.GetAllUserTraffic()
+			serverConfig, err := loadServerConfig(cmd, userManager)
 			if err != nil {
 				log.Fatal(err)
 			}
-			fmt.Println(info.String())
+			userID, _ := cmd.Flags().GetString("id")
+			prefix, _ := cmd.Flags().GetString("prefix")
+			description, _ := cmd.Flags().GetString("description")
+			if userID == "" || prefix == "" {
+				log.Fatal("You must provide a user ID and a prefix")
+			}
+			device := applyDevice(cmd)
+			userManager = userManager.WithDevice(device)
+
+			route, err := userManager.AddRoute(*serverConfig, userID, prefix, description)
+			checkApplyError(err)
+			fmt.Printf("Route %s advertised by %s\n", route.Prefix, userID)
+			reportDevice(userManager, device)
 		},
 	}
-	return updateEndpointsCmd
-}
+	addCmd.Flags().String("id", "", "User ID of the owner")
+	addCmd.Flags().String("prefix", "", "Prefix to advertise, e.g. 10.10.10.0/24")
+	addCmd.Flags().String("description", "", "Description")
+	addApplyFlags(addCmd)
 
-func Server() *cobra.Command {
-	serverCmd := &cobra.Command{
-		Use:   "server",
-		Short: "Run server",
+	removeCmd := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove a route, users accepting it stop accepting it",
 		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			prefix, _ := cmd.Flags().GetString("prefix")
+			if prefix == "" {
+				log.Fatal("You must provide a prefix")
+			}
+			device := applyDevice(cmd)
+			userManager = userManager.WithDevice(device)
 
-			r := gin.Default()
+			err = userManager.RemoveRoute(prefix)
+			checkApplyError(err)
+			fmt.Printf("Route %s removed\n", prefix)
+			reportDevice(userManager, device)
+		},
+	}
+	removeCmd.Flags().String("prefix", "", "Prefix")
+	addApplyFlags(removeCmd)
 
-			r.Use(cors.Default())
-			api := r.Group("/api")
-			api.POST("/setup", setupHandler)
-			api.POST("/adduser", addUserHandler)
-			api.POST("/deluser", deleteUserHandler)
-			api.POST("/getuser", getUserHandler)
-			api.POST("/getall", getAllUsersHandler)
-			api.POST("/getroutes", getAllRoutesHandler)
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List routes",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			routes, err := userManager.ListRoutes()
+			if err != nil {
+				log.Fatal(err)
+			}
 
-			addr, _ := cmd.Flags().GetString("addr")
-			if addr == "" {
-				addr = ":8080"
+			w := tabwriter.NewWriter(os.Stdout, 15, 20, 0, ' ', tabwriter.TabIndent)
+			fmt.Fprintf(w, "PREFIX\tOWNER\tENABLED\tDESCRIPTION\n")
+			for _, route := range routes {
+				fmt.Fprintf(w, "%s\t%s\t%t\t%s\t\n", route.Prefix, route.Owner, route.Enabled, route.Description)
 			}
+			w.Flush()
+		},
+	}
 
-			if err := r.Run(addr); err != nil {
+	acceptCmd := &cobra.Command{
+		Use:   "accept",
+		Short: "Let a user accept a route",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			userID, _ := cmd.Flags().GetString("id")
+			prefix, _ := cmd.Flags().GetString("prefix")
+			all, _ := cmd.Flags().GetBool("all")
+			if all {
+				if err := userManager.SetAcceptAllRoutes(userID, true); err != nil {
+					log.Fatal(err)
+				}
+				fmt.Printf("%s now accepts all routes, redistribute its config\n", userID)
+				return
+			}
+			if err := userManager.AcceptRoute(userID, prefix); err != nil {
 				log.Fatal(err)
 			}
+			fmt.Printf("%s now accepts %s, redistribute its config\n", userID, prefix)
 		},
 	}
-	serverCmd.Flags().String("addr", "", "ip:port")
-	return serverCmd
+	acceptCmd.Flags().String("id", "", "User ID")
+	acceptCmd.Flags().String("prefix", "", "Prefix")
+	acceptCmd.Flags().Bool("all", false, "Accept all current and future routes")
+	acceptCmd.MarkFlagsMutuallyExclusive("prefix", "all")
+
+	unacceptCmd := &cobra.Command{
+		Use:   "unaccept",
+		Short: "Stop a user accepting a route",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			userID, _ := cmd.Flags().GetString("id")
+			prefix, _ := cmd.Flags().GetString("prefix")
+			all, _ := cmd.Flags().GetBool("all")
+			if all {
+				if err := userManager.SetAcceptAllRoutes(userID, false); err != nil {
+					log.Fatal(err)
+				}
+				fmt.Printf("%s no longer accepts all routes, redistribute its config\n", userID)
+				return
+			}
+			if err := userManager.UnacceptRoute(userID, prefix); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%s no longer accepts %s, redistribute its config\n", userID, prefix)
+		},
+	}
+	unacceptCmd.Flags().String("id", "", "User ID")
+	unacceptCmd.Flags().String("prefix", "", "Prefix")
+	unacceptCmd.Flags().Bool("all", false, "Stop accepting all routes, explicitly accepted routes are kept")
+	unacceptCmd.MarkFlagsMutuallyExclusive("prefix", "all")
+
+	staleCmd := &cobra.Command{
+		Use:   "stale",
+		Short: "List users whose issued client config no longer matches their routes",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			stale, err := userManager.StaleConfigs()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 15, 20, 0, ' ', tabwriter.TabIndent)
+			fmt.Fprintf(w, "ID\tISSUED\tCURRENT\n")
+			for _, s := range stale {
+				issued := s.Issued
+				if issued == "" {
+					issued = "(not recorded)"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t\n", s.UserID, issued, s.Current)
+			}
+			w.Flush()
+		},
+	}
+
+	routeCmd.AddCommand(addCmd, removeCmd, listCmd, routeEnableCmd("enable", true), routeEnableCmd("disable", false), acceptCmd, unacceptCmd, staleCmd)
+	return routeCmd
+}
+
+// routeEnableCmd 生成 route enable/disable 子命令
+func routeEnableCmd(use string, enabled bool) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: strings.ToUpper(use[:1]) + use[1:] + " a route without removing it",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			prefix, _ := cmd.Flags().GetString("prefix")
+			if prefix == "" {
+				log.Fatal("You must provide a prefix")
+			}
+			device := applyDevice(cmd)
+			userManager = userManager.WithDevice(device)
+
+			err = userManager.SetRouteEnabled(prefix, enabled)
+			checkApplyError(err)
+			fmt.Printf("Route %s %sd\n", prefix, use)
+			reportDevice(userManager, device)
+		},
+	}
+	cmd.Flags().String("prefix", "", "Prefix")
+	addApplyFlags(cmd)
+	return cmd
+}
+
+func Disable() *cobra.Command {
+	return userDisableCmd("disable", true)
+}
+
+func Enable() *cobra.Command {
+	return userDisableCmd("enable", false)
+}
+
+// userDisableCmd 生成 disable/enable 命令
+func userDisableCmd(use string, disabled bool) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: strings.ToUpper(use[:1]) + use[1:] + " a user without deleting it",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			userIDs := selectUserIDs(cmd, userManager)
+			device := applyDevice(cmd)
+			userManager = userManager.WithDevice(device)
+
+			for _, userID := range userIDs {
+				err = userManager.SetUserDisabled(userID, disabled)
+				checkApplyError(err)
+				fmt.Printf("User %s %sd\n", userID, use)
+			}
+			fmt.Println("Run setup to refresh the server config")
+			reportDevice(userManager, device)
+		},
+	}
+	cmd.Flags().String("id", "", "User ID")
+	addGroupFlag(cmd, strings.ToUpper(use[:1])+use[1:]+" every member of the group")
+	addApplyFlags(cmd)
+	return cmd
+}
+
+func Expire() *cobra.Command {
+	expireCmd := &cobra.Command{
+		Use:   "expire",
+		Short: "Change when a user's access expires",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			userID, _ := cmd.Flags().GetString("id")
+			if userID == "" {
+				log.Fatal("You must provide a user ID")
+			}
+			expires, _ := cmd.Flags().GetString("expires")
+			if expires == "" {
+				log.Fatal("You must provide --expires, use never to remove the expiry")
+			}
+			expiresAt, err := parseExpiry(expires, time.Now())
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			device := applyDevice(cmd)
+			userManager = userManager.WithDevice(device)
+
+			err = userManager.SetUserExpiry(userID, expiresAt)
+			checkApplyError(err)
+			if expiresAt == nil {
+				fmt.Printf("User %s no longer expires\n", userID)
+			} else {
+				fmt.Printf("User %s expires at %s\n", userID, expiresAt.Local().Format(time.RFC3339))
+			}
+			reportDevice(userManager, device)
+		},
+	}
+	expireCmd.Flags().String("id", "", "User ID")
+	expireCmd.Flags().String("expires", "", "New period (30d, 2w, 12h), date (2006-01-02) or never")
+	addApplyFlags(expireCmd)
+	return expireCmd
+}
+
+func EditUser() *cobra.Command {
+	editUserCmd := &cobra.Command{
+		Use:   "edituser",
+		Short: "Change a user's allowed IPs, routes, hooks, keepalive or endpoint",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			serverConfig, err := loadServerConfig(cmd, userManager)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			userID, _ := cmd.Flags().GetString("id")
+			if userID == "" {
+				log.Fatal("You must provide a user ID")
+			}
+
+			// 只修改命令行中出现的字段，传空值可以清空钩子和路由
+			var patch UserPatch
+			for flag, field := range map[string]**string{
+				"allowedips":       &patch.AllowedIPs,
+				"endpoint":         &patch.Endpoint,
+				"preup":            &patch.PreUp,
+				"postup":           &patch.PostUp,
+				"predown":          &patch.PreDown,
+				"postdown":         &patch.PostDown,
+				"advertise-routes": &patch.AdvertiseRoutes,
+			} {
+				if cmd.Flags().Changed(flag) {
+					value, _ := cmd.Flags().GetString(flag)
+					*field = &value
+				}
+			}
+			if cmd.Flags().Changed("accept-routes") {
+				acceptRoutes, _ := cmd.Flags().GetStringSlice("accept-routes")
+				value := strings.Join(acceptRoutes, ",")
+				patch.AcceptRoutes = &value
+			}
+			if cmd.Flags().Changed("accept-all-routes") {
+				value, _ := cmd.Flags().GetBool("accept-all-routes")
+				patch.AcceptAllRoutes = &value
+			}
+			if cmd.Flags().Changed("persistent-keepalive") {
+				value, _ := cmd.Flags().GetInt("persistent-keepalive")
+				patch.PersistentKeepalive = &value
+			}
+			if patch == (UserPatch{}) {
+				log.Fatal("Nothing to change, see edituser --help for the editable fields")
+			}
+
+			device := applyDevice(cmd)
+			userManager = userManager.WithDevice(device)
+
+			before, after, err := userManager.EditUser(*serverConfig, userID, patch)
+			checkApplyError(err)
+			if diff := diffLines(before, after); diff != "" {
+				fmt.Printf("%s", diff)
+				fmt.Println("Distribute the new config to the user")
+			} else {
+				fmt.Println("No changes to the client config")
+			}
+			reportDevice(userManager, device)
+		},
+	}
+	editUserCmd.Flags().String("id", "", "User ID")
+	editUserCmd.Flags().String("allowedips", "", "For client side, which traffic can be passed to the server")
+	editUserCmd.Flags().String("endpoint", "", "Server endpoint in the client config, as host:port")
+	editUserCmd.Flags().Int("persistent-keepalive", 25, "Persistent keepalive interval in seconds, 0 disables it")
+	editUserCmd.Flags().String("advertise-routes", "", "Replace the routes the user advertises, empty to advertise none")
+	editUserCmd.Flags().StringSlice("accept-routes", nil, "Replace the accepted routes, as CIDRs or IDs of the users advertising them")
+	editUserCmd.Flags().Bool("accept-all-routes", false, "Accept every enabled route on the interface, including routes advertised later")
+	editUserCmd.MarkFlagsMutuallyExclusive("accept-routes", "accept-all-routes")
+	editUserCmd.Flags().String("preup", "", "Pre up")
+	editUserCmd.Flags().String("postup", "", "Post up")
+	editUserCmd.Flags().String("predown", "", "Pre down")
+	editUserCmd.Flags().String("postdown", "", "Post down")
+	addApplyFlags(editUserCmd)
+	return editUserCmd
+}
+
+func GroupCmd() *cobra.Command {
+	groupCmd := &cobra.Command{
+		Use:   "group",
+		Short: "Manage groups of users",
+	}
+
+	createCmd := &cobra.Command{
+		Use:   "create",
+		Short: "Create a group",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			name, _ := cmd.Flags().GetString("name")
+			description, _ := cmd.Flags().GetString("description")
+			if _, err := userManager.CreateGroup(name, description); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Group %s created\n", name)
+		},
+	}
+	createCmd.Flags().String("name", "", "Group name")
+	createCmd.Flags().String("description", "", "Description")
+
+	addCmd := &cobra.Command{
+		Use:   "add",
+		Short: "Add users to a group",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			name, _ := cmd.Flags().GetString("name")
+			userIDs, _ := cmd.Flags().GetStringSlice("id")
+			if err := userManager.AddGroupMembers(name, userIDs); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Added %s to %s\n", strings.Join(userIDs, ", "), name)
+		},
+	}
+	addCmd.Flags().String("name", "", "Group name")
+	addCmd.Flags().StringSlice("id", nil, "User IDs")
+
+	removeCmd := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove users from a group",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			name, _ := cmd.Flags().GetString("name")
+			userIDs, _ := cmd.Flags().GetStringSlice("id")
+			if err := userManager.RemoveGroupMembers(name, userIDs); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Removed %s from %s\n", strings.Join(userIDs, ", "), name)
+		},
+	}
+	removeCmd.Flags().String("name", "", "Group name")
+	removeCmd.Flags().StringSlice("id", nil, "User IDs")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List groups and their members on the interface",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			groups, err := userManager.ListGroups()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 15, 20, 0, ' ', tabwriter.TabIndent)
+			fmt.Fprintf(w, "NAME\tMEMBERS\tDESCRIPTION\n")
+			for _, group := range groups {
+				var members []string
+				for _, member := range group.Members {
+					members = append(members, member.UserID)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t\n", group.Name, strings.Join(members, ","), group.Description)
+			}
+			w.Flush()
+		},
+	}
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete",
+		Short: "Delete a group, its members are kept",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			name, _ := cmd.Flags().GetString("name")
+			if err := userManager.DeleteGroup(name); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Group %s deleted\n", name)
+		},
+	}
+	deleteCmd.Flags().String("name", "", "Group name")
+
+	groupCmd.AddCommand(createCmd, addCmd, removeCmd, listCmd, deleteCmd)
+	return groupCmd
+}
+
+func PolicyCmd() *cobra.Command {
+	policyCmd := &cobra.Command{
+		Use:   "policy",
+		Short: "Manage access rules between users, enforced with nftables on the server",
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add",
+		Short: "Allow a group to reach a prefix or another group",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			group, _ := cmd.Flags().GetString("group")
+			to, _ := cmd.Flags().GetString("to")
+			proto, _ := cmd.Flags().GetString("proto")
+			ports, _ := cmd.Flags().GetString("ports")
+			description, _ := cmd.Flags().GetString("description")
+			rule, err := userManager.AddPolicyRule(group, to, proto, ports, description)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Rule %d added, run setup to regenerate the server config\n", rule.ID)
+		},
+	}
+	addCmd.Flags().String("group", "", "Source group")
+	addCmd.Flags().String("to", "", "Destination CIDR or group")
+	addCmd.Flags().String("proto", "", "tcp or udp (default: any)")
+	addCmd.Flags().String("ports", "", "Destination ports, e.g. 22,8000-8080 (default: any)")
+	addCmd.Flags().String("description", "", "Description")
+
+	removeCmd := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove a rule",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			id, _ := cmd.Flags().GetUint("rule")
+			if err := userManager.RemovePolicyRule(id); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Rule %d removed, run setup to regenerate the server config\n", id)
+		},
+	}
+	removeCmd.Flags().Uint("rule", 0, "Rule ID")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List rules in evaluation order",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			rules, err := userManager.ListPolicyRules()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 15, 20, 0, ' ', tabwriter.TabIndent)
+			fmt.Fprintf(w, "ID\tGROUP\tTO\tPROTO\tPORTS\tDESCRIPTION\n")
+			for _, rule := range rules {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t\n", rule.ID, rule.Group.Name, rule.Destination, rule.Proto, rule.Ports, rule.Description)
+			}
+			w.Flush()
+		},
+	}
+
+	showCmd := &cobra.Command{
+		Use:   "show",
+		Short: "Print the nftables ruleset, e.g. for nft -f",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			serverConfig, err := loadServerConfig(cmd, userManager)
+			if err != nil {
+				log.Fatal(err)
+			}
+			rules, err := userManager.GeneratePolicy(*serverConfig)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Print(rules)
+		},
+	}
+
+	testCmd := &cobra.Command{
+		Use:   "test",
+		Short: "Check whether the policy allows a flow, without touching the firewall",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			serverConfig, err := loadServerConfig(cmd, userManager)
+			if err != nil {
+				log.Fatal(err)
+			}
+			from, _ := cmd.Flags().GetString("from")
+			to, _ := cmd.Flags().GetString("to")
+			proto, _ := cmd.Flags().GetString("proto")
+			port, _ := cmd.Flags().GetInt("port")
+			decision, err := userManager.EvaluatePolicy(*serverConfig, from, to, proto, port)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !decision.Allowed {
+				fmt.Printf("deny: %s\n", decision.Reason)
+				os.Exit(1)
+			}
+			fmt.Printf("allow: %s\n", decision.Reason)
+		},
+	}
+	testCmd.Flags().String("from", "", "Source user ID")
+	testCmd.Flags().String("to", "", "Destination user ID or IP address")
+	testCmd.Flags().String("proto", "", "tcp or udp (default: any)")
+	testCmd.Flags().Int("port", 0, "Destination port (default: any)")
+
+	policyCmd.AddCommand(addCmd, removeCmd, listCmd, showCmd, testCmd)
+	return policyCmd
+}
+
+func Get() *cobra.Command {
+	var getUserCmd = &cobra.Command{
+		Use:   "getuser",
+		Short: "Get a user from VPN",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			serverConfig, err := loadServerConfig(cmd, userManager)
+			if err != nil {
+				log.Fatal(err)
+			}
+			markIssued, _ := cmd.Flags().GetBool("mark-issued")
+			if group, _ := cmd.Flags().GetString("group"); group != "" {
+				outputDir, _ := cmd.Flags().GetString("output-dir")
+				writeUserConfigs(userManager, *serverConfig, selectUserIDs(cmd, userManager), outputDir, markIssued)
+				return
+			}
+
+			userID, _ := cmd.Flags().GetString("id")
+			if userID == "" {
+				log.Fatal("User ID is required")
+			}
+			getConfig := userManager.UserConfig
+			if markIssued {
+				getConfig = userManager.IssueUserConfig
+			}
+			config, err := getConfig(*serverConfig, userID)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%s", config)
+		},
+	}
+	getUserCmd.Flags().String("id", "", "User ID")
+	getUserCmd.Flags().Bool("mark-issued", false, "Record the configs as distributed, so route stale stops listing them")
+	addGroupFlag(getUserCmd, "Regenerate the configs of every member of the group")
+	getUserCmd.Flags().String("output-dir", "", "With --group, write one <id>.conf per user instead of printing the configs")
+	return getUserCmd
+}
+func GetAllUsers() *cobra.Command {
+	var getAllUsersCmd = &cobra.Command{
+		Use:   "getall",
+		Short: "Get all users from VPN",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			users, err := groupUserManager(cmd, userManager).GetAllUsers()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 15, 20, 0, ' ', tabwriter.TabIndent)
+			fmt.Fprintf(w, "ID\tIP\tIPV6\tGROUPS\tEXPIRES\tSTATUS\n")
+
+			now := time.Now()
+			for _, user := range users {
+				status := "active"
+				if user.Disabled {
+					status = "disabled"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t\n", user.UserID, user.IP, user.IPv6, strings.Join(groupNames(user.Groups), ","), remainingValidity(user, now), status)
+			}
+
+			w.Flush()
+		},
+	}
+	addGroupFlag(getAllUsersCmd, "Only list members of the group")
+	return getAllUsersCmd
+}
+
+func UpdateEndpoints() *cobra.Command {
+	var updateEndpointsCmd = &cobra.Command{
+		Use:   "updateendpoints",
+		Short: "Update user endpoints",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			serverConfig, err := loadServerConfig(cmd, userManager)
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = userManager.UpdateUserEndpoints(*serverConfig)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			fmt.Println("User endpoints updated successfully")
+		},
+	}
+	return updateEndpointsCmd
+}
+
+func Info() *cobra.Command {
+	var updateEndpointsCmd = &cobra.Command{
+		Use:   "info",
+		Short: "Get information about the endpoints",
+		Run: func(cmd *cobra.Command, args []string) {
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			info, err := groupUserManager(cmd, userManager).GetAllUserTraffic()
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(info.String())
+		},
+	}
+	addGroupFlag(updateEndpointsCmd, "Only show members of the group")
+	return updateEndpointsCmd
+}
+
+func Server() *cobra.Command {
+	serverCmd := &cobra.Command{
+		Use:   "server",
+		Short: "Run server",
+		Run: func(cmd *cobra.Command, args []string) {
+
+			addr, _ := cmd.Flags().GetString("addr")
+			if addr == "" {
+				addr = ":8080"
+			}
+			noAuth, _ := cmd.Flags().GetBool("no-auth")
+			if noAuth && !isLoopbackAddr(addr) {
+				log.Fatal("--no-auth is only allowed when binding to localhost, e.g. --addr 127.0.0.1:8080")
+			}
+
+			userManager, err := openUserManager(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			output, _ := cmd.Flags().GetString("output")
+			ctrl, err := NewController(userManager, configPath(cmd), output)
+			if err != nil {
+				log.Fatal(err)
+			}
+			stop := make(chan struct{})
+			defer close(stop)
+			go ctrl.WatchConfig(stop)
+			if reapInterval, _ := cmd.Flags().GetDuration("reap-interval"); reapInterval > 0 {
+				deleteExpired, _ := cmd.Flags().GetBool("delete-expired")
+				go ctrl.reapExpired(reapInterval, deleteExpired, stop)
+			}
+
+			r := gin.Default()
+
+			corsConfig := cors.DefaultConfig()
+			corsConfig.AllowAllOrigins = true
+			corsConfig.AddAllowHeaders("Authorization")
+			r.Use(cors.New(corsConfig))
+			api := r.Group("/api")
+			if !noAuth {
+				api.Use(authMiddleware(userManager))
+			}
+			ctrl.RegisterRoutes(api)
+
+			certFile, _ := cmd.Flags().GetString("tls-cert")
+			keyFile, _ := cmd.Flags().GetString("tls-key")
+			selfSigned, _ := cmd.Flags().GetBool("tls-self-signed")
+			clientCA, _ := cmd.Flags().GetString("tls-client-ca")
+			if selfSigned {
+				if certFile == "" {
+					certFile = "./tls.crt"
+				}
+				if keyFile == "" {
+					keyFile = "./tls.key"
+				}
+				hosts, _ := cmd.Flags().GetStringSlice("tls-hosts")
+				created, err := ensureSelfSignedCert(certFile, keyFile, hosts)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if created {
+					log.Printf("Generated self-signed certificate %s", certFile)
+				}
+			}
+			if (certFile == "") != (keyFile == "") {
+				log.Fatal("--tls-cert and --tls-key must be set together")
+			}
+			if clientCA != "" && certFile == "" {
+				log.Fatal("--tls-client-ca requires TLS, set --tls-cert/--tls-key or --tls-self-signed")
+			}
+
+			if certFile == "" {
+				if err := r.Run(addr); err != nil {
+					log.Fatal(err)
+				}
+				return
+			}
+
+			tlsConfig, err := serverTLSConfig(clientCA)
+			if err != nil {
+				log.Fatal(err)
+			}
+			srv := &http.Server{Addr: addr, Handler: r, TLSConfig: tlsConfig}
+			log.Printf("Listening and serving HTTPS on %s", addr)
+			if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	serverCmd.Flags().String("addr", "", "ip:port")
+	serverCmd.Flags().String("output", "./wg.conf", "Where the setup endpoint writes the generated server config")
+	serverCmd.Flags().String("tls-cert", "", "TLS certificate file")
+	serverCmd.Flags().String("tls-key", "", "TLS private key file")
+	serverCmd.Flags().Bool("tls-self-signed", false, "Generate a self-signed certificate on first start if the files do not exist")
+	serverCmd.Flags().StringSlice("tls-hosts", nil, "Extra host names or IPs for the self-signed certificate")
+	serverCmd.Flags().String("tls-client-ca", "", "CA bundle used to verify client certificates (mutual TLS)")
+	serverCmd.Flags().Bool("no-auth", false, "Disable API token authentication, only allowed with a localhost --addr")
+	serverCmd.Flags().Duration("reap-interval", time.Minute, "How often expired peers are removed from the live interfaces, 0 disables it")
+	serverCmd.Flags().Bool("delete-expired", false, "Delete expired users instead of only removing their peers from the interface")
+	return serverCmd
+}
+
+// addApplyFlags 为修改用户的命令添加 --apply/--device 参数
+func addApplyFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("apply", false, "Apply the change to the live WireGuard interface")
+	cmd.Flags().String("device", "", "WireGuard interface used by --apply (default: the --interface name)")
+}
+
+// applyDevice 返回需要同步的接口名，未指定 --apply 时为空
+func applyDevice(cmd *cobra.Command) string {
+	apply, _ := cmd.Flags().GetBool("apply")
+	if !apply {
+		return ""
+	}
+	device, _ := cmd.Flags().GetString("device")
+	if device == "" {
+		device = interfaceName(cmd)
+	}
+	return device
+}
+
+// checkApplyError 数据库写入失败时退出，仅同步接口失败时给出警告
+func checkApplyError(err error) {
+	if err == nil {
+		return
+	}
+	var applyErr *ApplyError
+	if errors.As(err, &applyErr) {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+		return
+	}
+	log.Fatal(err)
+}
+
+// reportDevice 输出接口状态是否与数据库一致，输出到 stderr 以免混入配置内容
+func reportDevice(um *UserManager, device string) {
+	if device == "" {
+		return
+	}
+	diff, err := um.CheckDevice(device)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to inspect interface %s: %v\n", device, err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, diff)
+}
+
+// addGroupFlag 为批量操作的命令添加 --group 参数
+func addGroupFlag(cmd *cobra.Command, usage string) {
+	cmd.Flags().String("group", "", usage)
+}
+
+// groupUserManager 按 --group 限定用户，未指定时原样返回
+func groupUserManager(cmd *cobra.Command, userManager *UserManager) *UserManager {
+	group, _ := cmd.Flags().GetString("group")
+	if group == "" {
+		return userManager
+	}
+	scoped, err := userManager.InGroup(group)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return scoped
+}
+
+// selectUserIDs 返回 --id 指定的用户，或 --group 分组的全部成员
+func selectUserIDs(cmd *cobra.Command, userManager *UserManager) []string {
+	userID, _ := cmd.Flags().GetString("id")
+	group, _ := cmd.Flags().GetString("group")
+	if (userID == "") == (group == "") {
+		log.Fatal("You must provide either --id or --group")
+	}
+	if userID != "" {
+		return []string{userID}
+	}
+	userIDs := allUserIDs(groupUserManager(cmd, userManager))
+	if len(userIDs) == 0 {
+		log.Fatalf("Group %s has no members on %s", group, userManager.Interface())
+	}
+	return userIDs
+}
+
+// allUserIDs 返回 userManager 可见的全部用户 ID
+func allUserIDs(userManager *UserManager) []string {
+	users, err := userManager.GetAllUsers()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var userIDs []string
+	for _, user := range users {
+		userIDs = append(userIDs, user.UserID)
+	}
+	return userIDs
+}
+
+// writeUserConfigs 输出用户的客户端配置，outputDir 非空时写入 <outputDir>/<id>.conf，
+// issue 时记录配置已下发
+func writeUserConfigs(userManager *UserManager, serverConfig ServerConfig, userIDs []string, outputDir string, issue bool) {
+	getConfig := userManager.UserConfig
+	if issue {
+		getConfig = userManager.IssueUserConfig
+	}
+	for _, userID := range userIDs {
+		config, err := getConfig(serverConfig, userID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		switch {
+		case outputDir != "":
+			output := filepath.Join(outputDir, userID+".conf")
+			if err := os.WriteFile(output, []byte(config), 0600); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Wrote %s\n", output)
+		case len(userIDs) > 1:
+			fmt.Printf("# %s\n%s\n", userID, config)
+		default:
+			fmt.Printf("%s", config)
+		}
+	}
+}
+
+const (
+	dbEnv        = "WG_MGR_DB"
+	configEnv    = "WG_MGR_CONFIG"
+	interfaceEnv = "WG_MGR_INTERFACE"
+)
+
+// addPathFlags 为根命令添加数据库、配置文件路径和接口选择参数
+func addPathFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("db", "", "Users database path (env "+dbEnv+", default ./users.db)")
+	cmd.PersistentFlags().String("config", "", "Server config path (env "+configEnv+", default server.yaml)")
+	cmd.PersistentFlags().String("interface", "", "Interface to operate on (env "+interfaceEnv+", default the name in server.yaml)")
+}
+
+// interfaceName 按 --interface、WG_MGR_INTERFACE、server.yaml 中 name 的顺序确定接口
+func interfaceName(cmd *cobra.Command) string {
+	if name := pathFlag(cmd, "interface", interfaceEnv, ""); name != "" {
+		return name
+	}
+	if fileConfig, err := LoadServerConfig(configPath(cmd)); err == nil {
+		return fileConfig.InterfaceName()
+	}
+	return defaultInterface
+}
+
+// openUserManager 打开数据库，并限定到选择的接口
+func openUserManager(cmd *cobra.Command) (*UserManager, error) {
+	userManager, err := NewUserManager(dbPath(cmd))
+	if err != nil {
+		return nil, err
+	}
+	return userManager.ForInterface(interfaceName(cmd)), nil
+}
+
+// loadServerConfig 返回选择的接口的配置，server.yaml 描述的接口从文件读取，其余从数据库读取
+func loadServerConfig(cmd *cobra.Command, userManager *UserManager) (*ServerConfig, error) {
+	fileConfig, err := LoadServerConfig(configPath(cmd))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return userManager.InterfaceConfig(fileConfig)
+}
+
+// dbPath 按 --db、WG_MGR_DB、默认值的顺序确定数据库路径
+func dbPath(cmd *cobra.Command) string {
+	return pathFlag(cmd, "db", dbEnv, "./users.db")
+}
+
+// configPath 按 --config、WG_MGR_CONFIG、默认值的顺序确定配置文件路径
+func configPath(cmd *cobra.Command) string {
+	return pathFlag(cmd, "config", configEnv, "server.yaml")
+}
+
+func pathFlag(cmd *cobra.Command, name, env, fallback string) string {
+	if value, _ := cmd.Flags().GetString(name); value != "" {
+		return value
+	}
+	if value := os.Getenv(env); value != "" {
+		return value
+	}
+	return fallback
 }
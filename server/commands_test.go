@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestPathFlagPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	fileConfig := filepath.Join(dir, "server.yaml")
+	if err := os.WriteFile(fileConfig, []byte("name: \"wg-file\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	envConfig := filepath.Join(dir, "env.yaml")
+	if err := os.WriteFile(envConfig, []byte("name: \"wg-env-file\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// resolve 按命令行参数解析路径和接口
+	resolve := func(t *testing.T, args ...string) (db, config, iface string) {
+		root := &cobra.Command{Use: "vpn-tool"}
+		addPathFlags(root)
+		root.AddCommand(&cobra.Command{
+			Use: "getall",
+			Run: func(cmd *cobra.Command, args []string) {
+				db, config, iface = dbPath(cmd), configPath(cmd), interfaceName(cmd)
+			},
+		})
+		root.SetArgs(append([]string{"getall"}, args...))
+		if err := root.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		return db, config, iface
+	}
+
+	tests := []struct {
+		name              string
+		env               map[string]string
+		args              []string
+		db, config, iface string
+	}{
+		{
+			name:   "flags",
+			args:   []string{"--db", "flag.db", "--config", fileConfig, "--interface", "wg-flag"},
+			db:     "flag.db",
+			config: fileConfig,
+			iface:  "wg-flag",
+		},
+		{
+			name:   "env",
+			env:    map[string]string{dbEnv: "env.db", configEnv: envConfig, interfaceEnv: "wg-env"},
+			db:     "env.db",
+			config: envConfig,
+			iface:  "wg-env",
+		},
+		{
+			name:   "flags override env",
+			env:    map[string]string{dbEnv: "env.db", configEnv: envConfig, interfaceEnv: "wg-env"},
+			args:   []string{"--db", "flag.db", "--config", fileConfig, "--interface", "wg-flag"},
+			db:     "flag.db",
+			config: fileConfig,
+			iface:  "wg-flag",
+		},
+		{
+			// 未指定接口时使用 --config 指向的文件中的 name，而不是 WG_MGR_CONFIG 的
+			name:   "interface from the config file",
+			env:    map[string]string{configEnv: envConfig},
+			args:   []string{"--config", fileConfig},
+			db:     "./users.db",
+			config: fileConfig,
+			iface:  "wg-file",
+		},
+		{
+			name:   "defaults",
+			db:     "./users.db",
+			config: "server.yaml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, env := range []string{dbEnv, configEnv, interfaceEnv} {
+				t.Setenv(env, tt.env[env])
+			}
+			db, config, iface := resolve(t, tt.args...)
+			if db != tt.db || config != tt.config {
+				t.Errorf("db, config = %s, %s, want %s, %s", db, config, tt.db, tt.config)
+			}
+			if tt.iface != "" && iface != tt.iface {
+				t.Errorf("interface = %s, want %s", iface, tt.iface)
+			}
+		})
+	}
+}
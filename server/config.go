@@ -1,8 +1,11 @@
 package main
 
 import (
-	"gopkg.in/yaml.v3"
+	"bytes"
+	"errors"
 	"os"
+
+	"gopkg.in/yaml.v3"
 )
 
 func LoadServerConfig(filePath string) (*ServerConfig, error) {
@@ -19,3 +22,52 @@ func LoadServerConfig(filePath string) (*ServerConfig, error) {
 
 	return &config, nil
 }
+
+// UpdateServerConfigValues 修改 YAML 文件中的指定字段，保留其余内容和注释
+func UpdateServerConfigValues(filePath string, values map[string]string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return errors.New("server config is not a YAML mapping")
+	}
+	root := doc.Content[0]
+
+	for key, value := range values {
+		found := false
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value == key {
+				root.Content[i+1].Value = value
+				found = true
+				break
+			}
+		}
+		if !found {
+			root.Content = append(root.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Value: key},
+				&yaml.Node{Kind: yaml.ScalarNode, Value: value, Style: yaml.DoubleQuotedStyle},
+			)
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, buf.Bytes(), info.Mode().Perm())
+}
@@ -1,58 +1,223 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 type AddUserRequest struct {
 	ID              string `json:"id"`
+	IP              string `json:"ip"`   // 可选，静态指定的 IPv4 地址
+	IPv6            string `json:"ipv6"` // 可选，静态指定的 IPv6 地址
 	AllowedIPs      string `json:"allowedips"`
 	PreUp           string `json:"pre_up"`
 	PostUp          string `json:"post_up"`
 	PreDown         string `json:"pre_down"`
 	PostDown        string `json:"post_down"`
 	AdvertiseRoutes string `json:"advertise_routes"`
-	AcceptRoutes    string `json:"accept_routes"`
+	AcceptRoutes    string `json:"accept_routes"` // 逗号分隔的 CIDR 或路由所有者的用户 ID
+	AcceptAllRoutes bool   `json:"accept_all_routes"`
+	Expires         string `json:"expires"` // 可选，如 30d 或 2006-01-02
+	PSK             bool   `json:"psk"`
+	PublicKey       string `json:"public_key"`
+	Apply           bool   `json:"apply"`
+	Device          string `json:"device"`
 }
 
 type DeleteUserRequest struct {
+	ID     string `json:"id"`
+	Apply  bool   `json:"apply"`
+	Device string `json:"device"`
+}
+
+type DisableUserRequest struct {
+	ID     string `json:"id"`
+	Apply  bool   `json:"apply"`
+	Device string `json:"device"`
+}
+
+// UpdateUserRequest 只修改请求中出现的字段
+type UpdateUserRequest struct {
 	ID string `json:"id"`
+	UserPatch
+	Apply  bool   `json:"apply"`
+	Device string `json:"device"`
+}
+
+type RotateKeyRequest struct {
+	ID        string `json:"id"`
+	PublicKey string `json:"public_key"`
+	Apply     bool   `json:"apply"`
+	Device    string `json:"device"`
 }
 
 type GetUserRequest struct {
 	ID string `json:"id"`
 }
 
+type UserConfigRequest struct {
+	ID         string `json:"id"`
+	MarkIssued bool   `json:"mark_issued"` // 记录配置已下发，route stale 不再列出该用户
+}
+
 type Response struct {
 	Message string      `json:"message"`
 	Data    interface{} `json:"data"`
 }
 
-func setupHandler(c *gin.Context) {
-	userManager, err := NewUserManager("./users.db")
+// configPollInterval 检查 server.yaml 是否被修改的间隔，测试时可以缩短
+var configPollInterval = 2 * time.Second
+
+// Controller 持有 API 服务共享的 UserManager 和服务端配置，
+// 配置可以在运行时通过 SIGHUP 或修改文件重新加载
+type Controller struct {
+	userManager *UserManager
+	configPath  string
+	outputPath  string // setup 生成的 wg.conf 路径
+
+	mu      sync.RWMutex
+	config  ServerConfig
+	modTime time.Time
+}
+
+func NewController(userManager *UserManager, configPath string, outputPath string) (*Controller, error) {
+	ctrl := &Controller{userManager: userManager, configPath: configPath, outputPath: outputPath}
+	if err := ctrl.Reload(); err != nil {
+		return nil, err
+	}
+	return ctrl, nil
+}
+
+// ServerConfig 返回当前生效的服务端配置
+func (ctrl *Controller) ServerConfig() ServerConfig {
+	ctrl.mu.RLock()
+	defer ctrl.mu.RUnlock()
+	return ctrl.config
+}
+
+// Reload 重新读取服务端配置，失败时保留原配置
+func (ctrl *Controller) Reload() error {
+	info, err := os.Stat(ctrl.configPath)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+		return err
+	}
+	config, err := LoadServerConfig(ctrl.configPath)
+	if err != nil {
+		return err
+	}
+
+	ctrl.mu.Lock()
+	defer ctrl.mu.Unlock()
+	ctrl.config = *config
+	ctrl.modTime = info.ModTime()
+	return nil
+}
+
+// WatchConfig 收到 SIGHUP 或配置文件被修改时重新加载，直到 stop 关闭
+func (ctrl *Controller) WatchConfig(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			ctrl.reloadAndLog("SIGHUP")
+		case <-ticker.C:
+			info, err := os.Stat(ctrl.configPath)
+			if err != nil {
+				continue
+			}
+			ctrl.mu.RLock()
+			changed := !info.ModTime().Equal(ctrl.modTime)
+			ctrl.mu.RUnlock()
+			if changed {
+				ctrl.reloadAndLog("file change")
+			}
+		}
+	}
+}
+
+func (ctrl *Controller) reloadAndLog(reason string) {
+	if err := ctrl.Reload(); err != nil {
+		log.Printf("failed to reload %s on %s: %v", ctrl.configPath, reason, err)
 		return
 	}
+	log.Printf("reloaded %s on %s", ctrl.configPath, reason)
+}
 
-	serverConfig, err := LoadServerConfig("server.yaml")
+// scope 根据查询参数 interface 选择接口，返回限定到该接口的 UserManager 和接口配置，
+// 未指定时使用 server.yaml 描述的接口。失败时已写入响应
+func (ctrl *Controller) scope(c *gin.Context) (*UserManager, ServerConfig, bool) {
+	fileConfig := ctrl.ServerConfig()
+	name := c.Query("interface")
+	if name == "" {
+		name = fileConfig.InterfaceName()
+	}
+	userManager := ctrl.userManager.ForInterface(name)
+	serverConfig, err := userManager.InterfaceConfig(&fileConfig)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+		c.JSON(http.StatusNotFound, Response{Message: "Interface not found", Data: gin.H{"error": err.Error()}})
+		return nil, ServerConfig{}, false
+	}
+	return userManager, *serverConfig, true
+}
+
+// RegisterRoutes 注册 API 路由及各自允许的角色
+func (ctrl *Controller) RegisterRoutes(api *gin.RouterGroup) {
+	admin := requireRole(RoleAdmin)
+	operator := requireRole(RoleAdmin, RoleOperator)
+	anyone := requireRole(RoleAdmin, RoleOperator, RoleSelf)
+	api.POST("/setup", admin, ctrl.setupHandler)
+	api.POST("/updateendpoints", admin, ctrl.updateUserEndpointsHandler)
+	api.POST("/adduser", operator, ctrl.addUserHandler)
+	api.POST("/deluser", operator, ctrl.deleteUserHandler)
+	api.POST("/disableuser", operator, ctrl.setUserDisabledHandler(true))
+	api.POST("/enableuser", operator, ctrl.setUserDisabledHandler(false))
+	api.PATCH("/updateuser", operator, ctrl.updateUserHandler)
+	api.POST("/rotatekey", operator, ctrl.rotateKeyHandler)
+	api.POST("/getall", operator, ctrl.getAllUsersHandler)
+	api.POST("/getroutes", operator, ctrl.getAllRoutesHandler)
+	api.POST("/staleconfigs", operator, ctrl.staleConfigsHandler)
+	api.POST("/getuser", anyone, ctrl.getUserHandler)
+	api.POST("/userconfig", anyone, ctrl.userConfigHandler)
+}
+
+func (ctrl *Controller) setupHandler(c *gin.Context) {
+	scoped, serverConfig, ok := ctrl.scope(c)
+	if !ok {
 		return
 	}
 
-	config, err := userManager.GenerateServerConfig(*serverConfig)
+	config, err := scoped.GenerateServerConfig(serverConfig)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
 		return
 	}
 
-	configPath := "./wg.conf"
-	err = os.WriteFile(configPath, []byte(config), 0644)
+	// server.yaml 之外的接口写到同目录下的 <name>.conf
+	output := ctrl.outputPath
+	if serverConfig.Name != ctrl.ServerConfig().InterfaceName() {
+		output = filepath.Join(filepath.Dir(ctrl.outputPath), serverConfig.Name+".conf")
+	}
+
+	err = os.WriteFile(output, []byte(config), 0644)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
 		return
@@ -61,7 +226,12 @@ func setupHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, Response{Message: "VPN server configuration setup successfully", Data: gin.H{"config": config}})
 }
 
-func addUserHandler(c *gin.Context) {
+func (ctrl *Controller) addUserHandler(c *gin.Context) {
+	scoped, serverConfig, ok := ctrl.scope(c)
+	if !ok {
+		return
+	}
+
 	var req AddUserRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": "Invalid request body"}})
@@ -73,55 +243,119 @@ func addUserHandler(c *gin.Context) {
 		return
 	}
 
-	userManager, err := NewUserManager("./users.db")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+	if req.PublicKey != "" {
+		if err := validatePublicKey(req.PublicKey); err != nil {
+			c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": err.Error()}})
+			return
+		}
+	}
+
+	// 与命令行的 --accept-routes、--accept-all-routes 一样互斥
+	if req.AcceptAllRoutes && len(splitList(req.AcceptRoutes)) > 0 {
+		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": "accept_routes cannot be combined with accept_all_routes"}})
 		return
 	}
 
-	serverConfig, err := LoadServerConfig("server.yaml")
+	expiresAt, err := parseExpiry(req.Expires, time.Now())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": err.Error()}})
 		return
 	}
 
 	endpoint := fmt.Sprintf("%s:%d", serverConfig.ServerIP, serverConfig.Port)
 	persistentKeepalive := 25
 
-	err = userManager.AddUser(&User{
+	device := requestDevice(req.Apply, req.Device, scoped.Interface())
+	userManager := scoped.WithDevice(device)
+
+	acceptedRoutes, err := scoped.SelectRoutes(splitList(req.AcceptRoutes))
+	if errors.Is(err, ErrInvalidRoute) || errors.Is(err, ErrRouteNotFound) {
+		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": err.Error()}})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+		return
+	}
+
+	var presharedKey string
+	if req.PSK {
+		presharedKey, err = userManager.NewPresharedKey()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+			return
+		}
+	}
+
+	err = userManager.AddUser(serverConfig, &User{
 		UserID:              req.ID,
+		IP:                  req.IP,
+		IPv6:                req.IPv6,
 		AllowedIPs:          req.AllowedIPs,
 		Endpoint:            endpoint,
-		AdvertiseRoutes:     req.AdvertiseRoutes,
-		AcceptRoutes:        req.AcceptRoutes,
+		AdvertisedRoutes:    newRoutes(req.AdvertiseRoutes),
+		AcceptedRoutes:      acceptedRoutes,
+		AcceptAllRoutes:     req.AcceptAllRoutes,
+		ExpiresAt:           expiresAt,
 		PersistentKeepalive: persistentKeepalive,
+		PresharedKey:        presharedKey,
+		PublicKey:           req.PublicKey,
 		PreUp:               req.PreUp,
 		PostUp:              req.PostUp,
 		PreDown:             req.PreDown,
 		PostDown:            req.PostDown,
+		CreatedBy:           createdBy(c),
 	})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+	if errors.Is(err, ErrAddressUnavailable) {
+		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": err.Error()}})
 		return
 	}
-
-	users, err := userManager.GetAllUsers()
-	if err != nil {
+	if errors.Is(err, ErrInvalidRoute) || errors.Is(err, ErrRouteNotFound) {
+		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": err.Error()}})
+		return
+	}
+	var conflict *RouteConflictError
+	if errors.As(err, &conflict) {
+		c.JSON(http.StatusConflict, Response{Message: "Conflict", Data: gin.H{
+			"error":    err.Error(),
+			"route":    conflict.Route,
+			"conflict": conflict.Conflict,
+			"owner":    conflict.Owner,
+		}})
+		return
+	}
+	if errors.Is(err, ErrUserExists) {
+		c.JSON(http.StatusConflict, Response{Message: "Conflict", Data: gin.H{"error": err.Error()}})
+		return
+	}
+	var applyErr *ApplyError
+	if err != nil && !errors.As(err, &applyErr) {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
 		return
 	}
 
-	for _, user := range users {
-		if user.UserID == req.ID {
-			c.JSON(http.StatusOK, Response{Message: "User added successfully", Data: gin.H{"user_config": generateUserConfig(*serverConfig, user)}})
-			return
-		}
+	config, err2 := userManager.IssueUserConfig(serverConfig, req.ID)
+	if errors.Is(err2, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, Response{Message: "User not found", Data: gin.H{"error": "User not found"}})
+		return
+	}
+	if err2 != nil {
+		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+		return
 	}
 
-	c.JSON(http.StatusNotFound, Response{Message: "User not found", Data: gin.H{"error": "User not found"}})
+	c.JSON(http.StatusOK, Response{Message: "User added successfully", Data: gin.H{
+		"user_config": config,
+		"apply":       applyResult(userManager, device, err),
+	}})
 }
 
-func deleteUserHandler(c *gin.Context) {
+func (ctrl *Controller) deleteUserHandler(c *gin.Context) {
+	scoped, _, ok := ctrl.scope(c)
+	if !ok {
+		return
+	}
+
 	var req DeleteUserRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": "Invalid request body"}})
@@ -133,23 +367,161 @@ func deleteUserHandler(c *gin.Context) {
 		return
 	}
 
-	userManager, err := NewUserManager("./users.db")
+	user, err := scoped.GetUser(req.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, Response{Message: "User not found", Data: gin.H{"error": "User not found"}})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
 		return
 	}
+	if !canModifyUser(c, user, "delete") {
+		return
+	}
+
+	device := requestDevice(req.Apply, req.Device, scoped.Interface())
+	userManager := scoped.WithDevice(device)
 
 	err = userManager.DeleteUser(req.ID)
+	var applyErr *ApplyError
+	if err != nil && !errors.As(err, &applyErr) {
+		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{Message: "User deleted successfully", Data: gin.H{
+		"user_id": req.ID,
+		"apply":   applyResult(userManager, device, err),
+	}})
+}
+
+// setUserDisabledHandler 生成禁用和重新启用用户的处理函数，与删除相同，操作员只能操作自己添加的用户，
+// 避免重新启用管理员暂停的用户
+func (ctrl *Controller) setUserDisabledHandler(disabled bool) gin.HandlerFunc {
+	action, message := "enable", "User enabled successfully"
+	if disabled {
+		action, message = "disable", "User disabled successfully"
+	}
+	return func(c *gin.Context) {
+		scoped, _, ok := ctrl.scope(c)
+		if !ok {
+			return
+		}
+
+		var req DisableUserRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": "Invalid request body"}})
+			return
+		}
+		if req.ID == "" {
+			c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": "User ID is required"}})
+			return
+		}
+
+		user, err := scoped.GetUser(req.ID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, Response{Message: "User not found", Data: gin.H{"error": "User not found"}})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+			return
+		}
+		if !canModifyUser(c, user, action) {
+			return
+		}
+
+		device := requestDevice(req.Apply, req.Device, scoped.Interface())
+		userManager := scoped.WithDevice(device)
+
+		err = userManager.SetUserDisabled(req.ID, disabled)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, Response{Message: "User not found", Data: gin.H{"error": "User not found"}})
+			return
+		}
+		var applyErr *ApplyError
+		if err != nil && !errors.As(err, &applyErr) {
+			c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+			return
+		}
+
+		c.JSON(http.StatusOK, Response{Message: message, Data: gin.H{
+			"user_id":  req.ID,
+			"disabled": disabled,
+			"apply":    applyResult(userManager, device, err),
+		}})
+	}
+}
+
+func (ctrl *Controller) updateUserHandler(c *gin.Context) {
+	scoped, serverConfig, ok := ctrl.scope(c)
+	if !ok {
+		return
+	}
+
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": "Invalid request body"}})
+		return
+	}
+	if req.ID == "" {
+		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": "User ID is required"}})
+		return
+	}
+
+	user, err := scoped.GetUser(req.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, Response{Message: "User not found", Data: gin.H{"error": "User not found"}})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
 		return
 	}
+	if !canModifyUser(c, user, "edit") {
+		return
+	}
+
+	device := requestDevice(req.Apply, req.Device, scoped.Interface())
+	userManager := scoped.WithDevice(device)
+
+	before, after, err := userManager.EditUser(serverConfig, req.ID, req.UserPatch)
+	if errors.Is(err, ErrInvalidUpdate) || errors.Is(err, ErrInvalidRoute) || errors.Is(err, ErrRouteNotFound) {
+		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": err.Error()}})
+		return
+	}
+	var conflict *RouteConflictError
+	if errors.As(err, &conflict) {
+		c.JSON(http.StatusConflict, Response{Message: "Conflict", Data: gin.H{
+			"error":    err.Error(),
+			"route":    conflict.Route,
+			"conflict": conflict.Conflict,
+			"owner":    conflict.Owner,
+		}})
+		return
+	}
+	var applyErr *ApplyError
+	if err != nil && !errors.As(err, &applyErr) {
+		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+		return
+	}
 
-	c.JSON(http.StatusOK, Response{Message: "User deleted successfully", Data: gin.H{"user_id": req.ID}})
+	c.JSON(http.StatusOK, Response{Message: "User updated successfully", Data: gin.H{
+		"user_id":     req.ID,
+		"diff":        diffLines(before, after),
+		"user_config": after,
+		"apply":       applyResult(userManager, device, err),
+	}})
 }
 
-func getUserHandler(c *gin.Context) {
-	var req GetUserRequest
+func (ctrl *Controller) rotateKeyHandler(c *gin.Context) {
+	scoped, serverConfig, ok := ctrl.scope(c)
+	if !ok {
+		return
+	}
+
+	var req RotateKeyRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": "Invalid request body"}})
 		return
@@ -160,77 +532,225 @@ func getUserHandler(c *gin.Context) {
 		return
 	}
 
-	userManager, err := NewUserManager("./users.db")
+	if req.PublicKey != "" {
+		if err := validatePublicKey(req.PublicKey); err != nil {
+			c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": err.Error()}})
+			return
+		}
+	}
+
+	user, err := scoped.GetUser(req.ID)
 	if err != nil {
+		c.JSON(http.StatusNotFound, Response{Message: "User not found", Data: gin.H{"error": "User not found"}})
+		return
+	}
+	if !canModifyUser(c, user, "rotate") {
+		return
+	}
+
+	device := requestDevice(req.Apply, req.Device, scoped.Interface())
+	userManager := scoped.WithDevice(device)
+
+	err = userManager.RotateUserKey(req.ID, req.PublicKey)
+	var applyErr *ApplyError
+	if err != nil && !errors.As(err, &applyErr) {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
 		return
 	}
 
-	users, err := userManager.GetAllUsers()
-	if err != nil {
+	config, err2 := userManager.IssueUserConfig(serverConfig, req.ID)
+	if err2 != nil {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
 		return
 	}
 
-	serverConfig, err := LoadServerConfig("server.yaml")
+	c.JSON(http.StatusOK, Response{Message: "User key rotated successfully", Data: gin.H{
+		"user_config": config,
+		"apply":       applyResult(userManager, device, err),
+	}})
+}
+
+func (ctrl *Controller) getUserHandler(c *gin.Context) {
+	scoped, _, ok := ctrl.scope(c)
+	if !ok {
+		return
+	}
+
+	var req GetUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": "Invalid request body"}})
+		return
+	}
+
+	if req.ID == "" {
+		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": "User ID is required"}})
+		return
+	}
+
+	if !canAccessUser(c, scoped.Interface(), req.ID) {
+		return
+	}
+
+	user, err := scoped.GetUserView(req.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, Response{Message: "User not found", Data: gin.H{"error": "User not found"}})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
 		return
 	}
 
-	for _, user := range users {
-		if user.UserID == req.ID {
-			c.JSON(http.StatusOK, Response{Message: "User found", Data: gin.H{"user_config": generateUserConfig(*serverConfig, user)}})
-			return
-		}
+	c.JSON(http.StatusOK, Response{Message: "User found", Data: user})
+}
+
+// userConfigHandler 下载用户的客户端配置，这是 API 中唯一返回私钥的只读接口
+func (ctrl *Controller) userConfigHandler(c *gin.Context) {
+	scoped, serverConfig, ok := ctrl.scope(c)
+	if !ok {
+		return
 	}
 
-	c.JSON(http.StatusNotFound, Response{Message: "User not found", Data: gin.H{"error": "User not found"}})
-}
+	var req UserConfigRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": "Invalid request body"}})
+		return
+	}
 
-func getAllUsersHandler(c *gin.Context) {
-	userManager, err := NewUserManager("./users.db")
+	if req.ID == "" {
+		c.JSON(http.StatusBadRequest, Response{Message: "Bad Request", Data: gin.H{"error": "User ID is required"}})
+		return
+	}
+
+	if !canAccessUser(c, scoped.Interface(), req.ID) {
+		return
+	}
+	user, err := scoped.GetUser(req.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, Response{Message: "User not found", Data: gin.H{"error": "User not found"}})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
 		return
 	}
+	if !canReadUserConfig(c, user) {
+		return
+	}
 
-	users, err := userManager.GetAllUsers()
+	getConfig := scoped.UserConfig
+	if req.MarkIssued {
+		getConfig = scoped.IssueUserConfig
+	}
+	config, err := getConfig(serverConfig, req.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, Response{Message: "User not found", Data: gin.H{"error": "User not found"}})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
 		return
 	}
 
-	c.JSON(http.StatusOK, Response{Message: "Users retrieved successfully", Data: users})
+	c.JSON(http.StatusOK, Response{Message: "User config retrieved successfully", Data: gin.H{"user_config": config}})
 }
 
-func getAllRoutesHandler(c *gin.Context) {
-	userManager, err := NewUserManager("./users.db")
+func (ctrl *Controller) getAllUsersHandler(c *gin.Context) {
+	scoped, _, ok := ctrl.scope(c)
+	if !ok {
+		return
+	}
+
+	if group := c.Query("group"); group != "" {
+		var err error
+		scoped, err = scoped.InGroup(group)
+		if errors.Is(err, ErrGroupNotFound) {
+			c.JSON(http.StatusNotFound, Response{Message: "Group not found", Data: gin.H{"error": err.Error()}})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+			return
+		}
+	}
+
+	users, err := scoped.GetUserViews()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+		return
 	}
-	routes, err := userManager.GetAllRoutes()
+
+	c.JSON(http.StatusOK, Response{Message: "Users retrieved successfully", Data: users})
+}
+
+func (ctrl *Controller) getAllRoutesHandler(c *gin.Context) {
+	scoped, _, ok := ctrl.scope(c)
+	if !ok {
+		return
+	}
+
+	routes, err := scoped.GetAllRoutes()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+		return
 	}
 	c.JSON(http.StatusOK, Response{Message: "Routes retrieved successfully", Data: routes})
 }
 
-func updateUserEndpointsHandler(c *gin.Context) {
-	userManager, err := NewUserManager("./users.db")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
+func (ctrl *Controller) staleConfigsHandler(c *gin.Context) {
+	scoped, _, ok := ctrl.scope(c)
+	if !ok {
 		return
 	}
-	serverConfig, err := LoadServerConfig("./server.yaml")
+
+	stale, err := scoped.StaleConfigs()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
 		return
 	}
-	err = userManager.UpdateUserEndpoints(*serverConfig)
+	c.JSON(http.StatusOK, Response{Message: "Stale configs retrieved successfully", Data: stale})
+}
+
+func (ctrl *Controller) updateUserEndpointsHandler(c *gin.Context) {
+	scoped, serverConfig, ok := ctrl.scope(c)
+	if !ok {
+		return
+	}
+
+	err := scoped.UpdateUserEndpoints(serverConfig)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{Message: "Internal Server Error"})
 		return
 	}
 	c.JSON(http.StatusOK, Response{Message: "User endpoints updated successfully"})
 }
+
+// requestDevice 返回请求需要同步的接口名，未要求同步时为空，未指定时使用所选接口
+func requestDevice(apply bool, device string, iface string) string {
+	if !apply {
+		return ""
+	}
+	if device == "" {
+		return iface
+	}
+	return device
+}
+
+// applyResult 汇总接口同步结果，未要求同步时返回 nil
+func applyResult(um *UserManager, device string, applyErr error) gin.H {
+	if device == "" {
+		return nil
+	}
+	result := gin.H{"device": device, "in_sync": false}
+	if applyErr != nil {
+		result["error"] = applyErr.Error()
+	}
+	diff, err := um.CheckDevice(device)
+	if err != nil {
+		result["error"] = err.Error()
+		return result
+	}
+	result["in_sync"] = diff.InSync()
+	result["diff"] = diff
+	return result
+}
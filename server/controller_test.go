@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeTestServerConfig 在 dir 中写入 wg0 的 server.yaml，返回其路径
+func writeTestServerConfig(t *testing.T, dir string) string {
+	configPath := filepath.Join(dir, "server.yaml")
+	if err := os.WriteFile(configPath, []byte("server_ip: \"1.1.1.1\"\nport: 51820\nip: \"100.10.10.1/24\"\nip_pool: \"100.10.10.0/24\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return configPath
+}
+
+// newTestRouter 返回注册了全部 API 路由的 gin.Engine，server.yaml 写在 dir 中
+func newTestRouter(t *testing.T, um *UserManager, dir string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	ctrl, err := NewController(um, writeTestServerConfig(t, dir), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	api := r.Group("/api")
+	api.Use(authMiddleware(um))
+	ctrl.RegisterRoutes(api)
+	return r
+}
+
+// apiRequest 以 token 发送 JSON 请求
+func apiRequest(r *gin.Engine, token, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestUserViewsOmitSecrets(t *testing.T) {
+	dir := t.TempDir()
+	um := openTestUserManager(t, filepath.Join(dir, "users.db"))
+	if err := um.AddUser(testServerConfig, &User{UserID: "alice", PresharedKey: "psk-secret"}); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := um.CreateToken("ci", RoleAdmin, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter(t, um, dir)
+
+	post := func(path string) string {
+		w := apiRequest(r, token, path, `{"id": "alice"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d: %s", path, w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+
+	for _, path := range []string{"/api/getall", "/api/getuser"} {
+		body := post(path)
+		if !strings.Contains(body, `"user_id":"alice"`) {
+			t.Errorf("%s does not return alice: %s", path, body)
+		}
+		for _, secret := range []string{`"private_key"`, `"preshared_key"`, "private-1", "psk-secret"} {
+			if strings.Contains(body, secret) {
+				t.Errorf("%s leaks %s: %s", path, secret, body)
+			}
+		}
+	}
+	// 私钥只出现在客户端配置中
+	if body := post("/api/userconfig"); !strings.Contains(body, "PrivateKey = private-1") {
+		t.Errorf("/api/userconfig lacks the private key: %s", body)
+	}
+}
+
+func TestDisableUserOwnership(t *testing.T) {
+	dir := t.TempDir()
+	um := openTestUserManager(t, filepath.Join(dir, "users.db"))
+	for _, user := range []*User{{UserID: "alice"}, {UserID: "bob", CreatedBy: "ops"}} {
+		if err := um.AddUser(testServerConfig, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	adminToken, _, err := um.CreateToken("admin", RoleAdmin, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	operatorToken, _, err := um.CreateToken("ops", RoleOperator, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter(t, um, dir)
+
+	// 管理员暂停的用户不能被操作员重新启用
+	cases := []struct {
+		token string
+		path  string
+		id    string
+		want  int
+	}{
+		{adminToken, "/api/disableuser", "alice", http.StatusOK},
+		{operatorToken, "/api/enableuser", "alice", http.StatusForbidden},
+		{operatorToken, "/api/disableuser", "alice", http.StatusForbidden},
+		{operatorToken, "/api/disableuser", "bob", http.StatusOK},
+		{operatorToken, "/api/enableuser", "bob", http.StatusOK},
+		{operatorToken, "/api/disableuser", "nobody", http.StatusNotFound},
+		{operatorToken, "/api/rotatekey", "alice", http.StatusForbidden},
+		{operatorToken, "/api/rotatekey", "bob", http.StatusOK},
+	}
+	for _, tc := range cases {
+		if w := apiRequest(r, tc.token, tc.path, `{"id": "`+tc.id+`"}`); w.Code != tc.want {
+			t.Errorf("%s %s: got %d, want %d: %s", tc.path, tc.id, w.Code, tc.want, w.Body)
+		}
+	}
+	alice, err := um.GetUser("alice")
+	if err != nil || !alice.Disabled {
+		t.Errorf("alice = %+v, %v, want still disabled", alice, err)
+	}
+	if alice.PublicKey != "public-1" {
+		t.Errorf("alice's key was rotated by an operator: %s", alice.PublicKey)
+	}
+}
+
+func TestUserConfigOwnership(t *testing.T) {
+	dir := t.TempDir()
+	um := openTestUserManager(t, filepath.Join(dir, "users.db"))
+	for _, user := range []*User{{UserID: "alice"}, {UserID: "bob", CreatedBy: "ops"}} {
+		if err := um.AddUser(testServerConfig, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tokens := make(map[string]string)
+	for name, role := range map[string]Role{"admin": RoleAdmin, "ops": RoleOperator, "alice": RoleSelf} {
+		userID := ""
+		if role == RoleSelf {
+			userID = name
+		}
+		token, _, err := um.CreateToken(name, role, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[name] = token
+	}
+	r := newTestRouter(t, um, dir)
+
+	// 配置中含有私钥，operator 只能读取自己添加的用户
+	cases := []struct {
+		token string
+		id    string
+		want  int
+	}{
+		{"admin", "alice", http.StatusOK},
+		{"admin", "bob", http.StatusOK},
+		{"ops", "alice", http.StatusForbidden},
+		{"ops", "bob", http.StatusOK},
+		{"ops", "nobody", http.StatusNotFound},
+		{"alice", "alice", http.StatusOK},
+		{"alice", "bob", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		w := apiRequest(r, tokens[tc.token], "/api/userconfig", `{"id": "`+tc.id+`"}`)
+		if w.Code != tc.want {
+			t.Errorf("%s reading %s: got %d, want %d: %s", tc.token, tc.id, w.Code, tc.want, w.Body)
+		}
+		if w.Code != http.StatusOK && strings.Contains(w.Body.String(), "PrivateKey") {
+			t.Errorf("%s reading %s leaked the config: %s", tc.token, tc.id, w.Body)
+		}
+	}
+
+	// self 令牌只能访问创建时所在接口上的同名用户
+	if err := um.CreateInterface(&Interface{Name: "wg1", Port: 51821, IP: "100.20.20.1/24", IPPool: "100.20.20.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	wg1 := um.ForInterface("wg1")
+	wg1Config, err := wg1.InterfaceConfig(&testServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wg1.AddUser(*wg1Config, &User{UserID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := apiRequest(r, tokens["alice"], "/api/userconfig?interface=wg1", `{"id": "alice"}`); w.Code != http.StatusForbidden {
+		t.Errorf("alice's wg0 token reading alice on wg1: got %d, want 403: %s", w.Code, w.Body)
+	}
+}
+
+func TestControllerReload(t *testing.T) {
+	dir := t.TempDir()
+	um := openTestUserManager(t, filepath.Join(dir, "users.db"))
+	configPath := writeTestServerConfig(t, dir)
+	ctrl, err := NewController(um, configPath, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := ctrl.ServerConfig().Port; port != 51820 {
+		t.Fatalf("port = %d, want 51820", port)
+	}
+
+	// writeConfig 写入配置并推后修改时间，确保轮询能发现变化
+	modTime := time.Now()
+	writeConfig := func(content string) {
+		if err := os.WriteFile(configPath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(configPath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig("server_ip: \"2.2.2.2\"\nport: 51830\nip: \"100.10.10.1/24\"\nip_pool: \"100.10.10.0/24\"\n")
+	if err := ctrl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if config := ctrl.ServerConfig(); config.Port != 51830 || config.ServerIP != "2.2.2.2" {
+		t.Errorf("config after reload = %+v, want port 51830 on 2.2.2.2", config)
+	}
+
+	// 无法解析的文件保留原配置
+	writeConfig("port: [\n")
+	if err := ctrl.Reload(); err == nil {
+		t.Error("reloaded an invalid server.yaml")
+	}
+	if port := ctrl.ServerConfig().Port; port != 51830 {
+		t.Errorf("port after an invalid reload = %d, want 51830", port)
+	}
+
+	// WatchConfig 发现文件修改后重新加载
+	interval := configPollInterval
+	configPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { configPollInterval = interval })
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ctrl.WatchConfig(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	writeConfig("server_ip: \"2.2.2.2\"\nport: 51840\nip: \"100.10.10.1/24\"\nip_pool: \"100.10.10.0/24\"\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for ctrl.ServerConfig().Port != 51840 {
+		if time.Now().After(deadline) {
+			t.Fatalf("WatchConfig did not pick up the change, port = %d", ctrl.ServerConfig().Port)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAddUserAcceptRoutes(t *testing.T) {
+	dir := t.TempDir()
+	um := openTestUserManager(t, filepath.Join(dir, "users.db"))
+	if err := um.AddUser(testServerConfig, &User{UserID: "site-a", AdvertisedRoutes: newRoutes("10.1.0.0/16")}); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := um.CreateToken("ci", RoleAdmin, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter(t, um, dir)
+
+	cases := []struct {
+		body string
+		want int
+	}{
+		{`{"id": "laptop", "accept_routes": "site-a", "accept_all_routes": true}`, http.StatusBadRequest},
+		{`{"id": "laptop", "accept_routes": "site-a"}`, http.StatusOK},
+		{`{"id": "phone", "accept_routes": "", "accept_all_routes": true}`, http.StatusOK},
+	}
+	for _, tc := range cases {
+		if w := apiRequest(r, token, "/api/adduser", tc.body); w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.body, w.Code, tc.want, w.Body)
+		}
+	}
+	if _, err := um.GetUser("phone"); err != nil {
+		t.Errorf("phone was not added: %v", err)
+	}
+}
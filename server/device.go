@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// wgClient 是 wgctrl.Client 的最小子集，测试时可以替换
+type wgClient interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+	Close() error
+}
+
+var newWGClient = func() (wgClient, error) {
+	return wgctrl.New()
+}
+
+// ApplyError 表示数据库已经更新，但同步到 WireGuard 接口失败
+type ApplyError struct {
+	Device  string
+	Updated string // 已经写入的位置，为空表示 users.db
+	Err     error
+}
+
+func (e *ApplyError) Error() string {
+	updated := e.Updated
+	if updated == "" {
+		updated = "users.db"
+	}
+	return fmt.Sprintf("%s updated but failed to apply to %s: %v", updated, e.Device, e.Err)
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// DeviceDiff 描述 users.db 与内核中接口状态的差异
+type DeviceDiff struct {
+	Device     string   `json:"device"`
+	Missing    []string `json:"missing"`    // 数据库中有、接口上没有的用户
+	Unknown    []string `json:"unknown"`    // 接口上有、数据库中没有的公钥
+	Mismatched []string `json:"mismatched"` // AllowedIPs 或 PresharedKey 不一致的用户
+}
+
+// InSync 接口状态与数据库完全一致
+func (d *DeviceDiff) InSync() bool {
+	return len(d.Missing) == 0 && len(d.Unknown) == 0 && len(d.Mismatched) == 0
+}
+
+func (d *DeviceDiff) String() string {
+	if d.InSync() {
+		return fmt.Sprintf("interface %s is in sync with users.db", d.Device)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "interface %s is out of sync with users.db\n", d.Device)
+	if len(d.Missing) > 0 {
+		fmt.Fprintf(&sb, "  missing on interface: %s\n", strings.Join(d.Missing, ", "))
+	}
+	if len(d.Unknown) > 0 {
+		fmt.Fprintf(&sb, "  unknown peers: %s\n", strings.Join(d.Unknown, ", "))
+	}
+	if len(d.Mismatched) > 0 {
+		fmt.Fprintf(&sb, "  peer config differs: %s\n", strings.Join(d.Mismatched, ", "))
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// peerAllowedIPs 服务端视角下该用户的 AllowedIPs
+func peerAllowedIPs(user User) ([]net.IPNet, error) {
+	prefixes := append(hostPrefixes(user), routePrefixes(user.AdvertisedRoutes, true)...)
+
+	var allowedIPs []net.IPNet
+	for _, prefix := range prefixes {
+		_, ipnet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed ip %q for user %s: %w", prefix, user.UserID, err)
+		}
+		allowedIPs = append(allowedIPs, *ipnet)
+	}
+	return allowedIPs, nil
+}
+
+// peerConfig 根据用户生成服务端的 Peer 配置，已禁用或过期的用户从接口上删除
+func peerConfig(user User) (wgtypes.PeerConfig, error) {
+	if !user.Active(time.Now()) {
+		return removePeerConfig(user.PublicKey)
+	}
+	publicKey, err := wgtypes.ParseKey(user.PublicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, fmt.Errorf("invalid public key for user %s: %w", user.UserID, err)
+	}
+	allowedIPs, err := peerAllowedIPs(user)
+	if err != nil {
+		return wgtypes.PeerConfig{}, err
+	}
+	// 未设置预共享密钥时下发全零密钥，清除接口上旧的 PSK
+	presharedKey := wgtypes.Key{}
+	if user.PresharedKey != "" {
+		presharedKey, err = wgtypes.ParseKey(user.PresharedKey)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("invalid preshared key for user %s: %w", user.UserID, err)
+		}
+	}
+	return wgtypes.PeerConfig{
+		PublicKey:         publicKey,
+		PresharedKey:      &presharedKey,
+		ReplaceAllowedIPs: true,
+		AllowedIPs:        allowedIPs,
+	}, nil
+}
+
+// removePeerConfig 生成删除 Peer 的配置
+func removePeerConfig(publicKey string) (wgtypes.PeerConfig, error) {
+	key, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, err
+	}
+	return wgtypes.PeerConfig{PublicKey: key, Remove: true}, nil
+}
+
+// configurePeers 将 Peer 的增量变更下发到接口
+func configurePeers(device string, peers []wgtypes.PeerConfig) error {
+	if len(peers) == 0 {
+		return nil
+	}
+	client, err := newWGClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.ConfigureDevice(device, wgtypes.Config{Peers: peers})
+}
+
+// configureDeviceKey 更换接口的私钥
+func configureDeviceKey(device string, privateKey string) error {
+	key, err := wgtypes.ParseKey(privateKey)
+	if err != nil {
+		return err
+	}
+	client, err := newWGClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.ConfigureDevice(device, wgtypes.Config{PrivateKey: &key})
+}
+
+// peerHandshakes 返回所有接口上各公钥最近一次握手的时间，出错时返回空表
+func peerHandshakes() map[string]time.Time {
+	handshakes := make(map[string]time.Time)
+	client, err := wgctrl.New()
+	if err != nil {
+		return handshakes
+	}
+	defer client.Close()
+
+	devices, err := client.Devices()
+	if err != nil {
+		return handshakes
+	}
+	for _, device := range devices {
+		for _, peer := range device.Peers {
+			handshakes[peer.PublicKey.String()] = peer.LastHandshakeTime
+		}
+	}
+	return handshakes
+}
+
+// diffDevice 比较数据库中的用户与接口上的 Peer
+func diffDevice(device *wgtypes.Device, users []User) *DeviceDiff {
+	diff := &DeviceDiff{Device: device.Name}
+
+	peers := make(map[string]wgtypes.Peer, len(device.Peers))
+	for _, peer := range device.Peers {
+		peers[peer.PublicKey.String()] = peer
+	}
+
+	known := make(map[string]bool, len(users))
+	for _, user := range users {
+		known[user.PublicKey] = true
+		peer, ok := peers[user.PublicKey]
+		if !ok {
+			diff.Missing = append(diff.Missing, user.UserID)
+			continue
+		}
+		expected, err := peerAllowedIPs(user)
+		if err != nil || !sameIPNets(expected, peer.AllowedIPs) || !samePresharedKey(user.PresharedKey, peer.PresharedKey) {
+			diff.Mismatched = append(diff.Mismatched, user.UserID)
+		}
+	}
+	for key := range peers {
+		if !known[key] {
+			diff.Unknown = append(diff.Unknown, key)
+		}
+	}
+	sort.Strings(diff.Unknown)
+
+	return diff
+}
+
+func samePresharedKey(psk string, key wgtypes.Key) bool {
+	if psk == "" {
+		return key == wgtypes.Key{}
+	}
+	return psk == key.String()
+}
+
+func sameIPNets(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, n := range a {
+		set[n.String()] = true
+	}
+	for _, n := range b {
+		if !set[n.String()] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestDiffDevice(t *testing.T) {
+	keyA, _ := wgtypes.GeneratePrivateKey()
+	keyB, _ := wgtypes.GeneratePrivateKey()
+	keyC, _ := wgtypes.GeneratePrivateKey()
+	_, ipA, _ := net.ParseCIDR("100.10.10.3/32")
+	_, ipB, _ := net.ParseCIDR("100.10.10.4/32")
+
+	users := []User{
+		{UserID: "a", PublicKey: keyA.PublicKey().String(), IP: "100.10.10.3"},
+		{UserID: "b", PublicKey: keyB.PublicKey().String(), IP: "100.10.10.4", AdvertisedRoutes: newRoutes("10.10.10.0/24")},
+		{UserID: "c", PublicKey: keyC.PublicKey().String(), IP: "100.10.10.5"},
+	}
+	unknown, _ := wgtypes.GeneratePrivateKey()
+	device := &wgtypes.Device{
+		Name: "wg0",
+		Peers: []wgtypes.Peer{
+			{PublicKey: keyA.PublicKey(), AllowedIPs: []net.IPNet{*ipA}},
+			{PublicKey: keyB.PublicKey(), AllowedIPs: []net.IPNet{*ipB}},
+			{PublicKey: unknown.PublicKey()},
+		},
+	}
+
+	diff := diffDevice(device, users)
+	if diff.InSync() {
+		t.Fatal("expected device to be out of sync")
+	}
+	if len(diff.Missing) != 1 || diff.Missing[0] != "c" {
+		t.Errorf("missing = %v, want [c]", diff.Missing)
+	}
+	if len(diff.Mismatched) != 1 || diff.Mismatched[0] != "b" {
+		t.Errorf("mismatched = %v, want [b]", diff.Mismatched)
+	}
+	if len(diff.Unknown) != 1 || diff.Unknown[0] != unknown.PublicKey().String() {
+		t.Errorf("unknown = %v, want [%s]", diff.Unknown, unknown.PublicKey())
+	}
+}
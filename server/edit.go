@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidUpdate 修改后的用户配置不合法
+var ErrInvalidUpdate = errors.New("invalid update")
+
+// UserPatch 是对用户的部分修改，nil 字段保持不变
+type UserPatch struct {
+	AllowedIPs          *string `json:"allowedips"`
+	Endpoint            *string `json:"endpoint"`
+	PersistentKeepalive *int    `json:"persistent_keepalive"`
+	PreUp               *string `json:"pre_up"`
+	PostUp              *string `json:"post_up"`
+	PreDown             *string `json:"pre_down"`
+	PostDown            *string `json:"post_down"`
+	AdvertiseRoutes     *string `json:"advertise_routes"` // 逗号分隔，替换用户广播的全部路由
+	AcceptRoutes        *string `json:"accept_routes"`    // 逗号分隔的 CIDR 或路由所有者，替换用户接受的全部路由
+	AcceptAllRoutes     *bool   `json:"accept_all_routes"`
+}
+
+// columns 校验 patch 中的普通字段，返回要写入的列
+func (p UserPatch) columns() (map[string]interface{}, error) {
+	columns := make(map[string]interface{})
+	if p.AllowedIPs != nil {
+		prefixes := splitList(*p.AllowedIPs)
+		if len(prefixes) == 0 {
+			return nil, fmt.Errorf("%w: allowed IPs must not be empty", ErrInvalidUpdate)
+		}
+		for _, prefix := range prefixes {
+			if _, err := netip.ParsePrefix(prefix); err != nil {
+				return nil, fmt.Errorf("%w: allowed IP %q is not a CIDR", ErrInvalidUpdate, prefix)
+			}
+		}
+		columns["allowed_ips"] = strings.Join(prefixes, ", ")
+	}
+	if p.Endpoint != nil {
+		endpoint := strings.TrimSpace(*p.Endpoint)
+		host, port, err := net.SplitHostPort(endpoint)
+		if n, perr := strconv.Atoi(port); err != nil || host == "" || perr != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("%w: endpoint %q is not host:port", ErrInvalidUpdate, endpoint)
+		}
+		columns["endpoint"] = endpoint
+	}
+	if p.PersistentKeepalive != nil {
+		if *p.PersistentKeepalive < 0 || *p.PersistentKeepalive > 65535 {
+			return nil, fmt.Errorf("%w: persistent keepalive must be between 0 and 65535", ErrInvalidUpdate)
+		}
+		columns["persistent_keepalive"] = *p.PersistentKeepalive
+	}
+	for column, hook := range map[string]*string{"pre_up": p.PreUp, "post_up": p.PostUp, "pre_down": p.PreDown, "post_down": p.PostDown} {
+		if hook == nil {
+			continue
+		}
+		// 换行会在配置文件中插入额外的行
+		if strings.ContainsAny(*hook, "\r\n") {
+			return nil, fmt.Errorf("%w: %s must be a single line", ErrInvalidUpdate, column)
+		}
+		columns[column] = *hook
+	}
+	if p.AcceptAllRoutes != nil {
+		// 与 adduser 相同，接受全部路由时不能再指定路由
+		if *p.AcceptAllRoutes && p.acceptsRoutes() {
+			return nil, fmt.Errorf("%w: accept_routes cannot be combined with accept_all_routes", ErrInvalidUpdate)
+		}
+		columns["accept_all_routes"] = *p.AcceptAllRoutes
+	}
+	return columns, nil
+}
+
+// acceptsRoutes 判断 patch 是否指定了要接受的路由
+func (p UserPatch) acceptsRoutes() bool {
+	return p.AcceptRoutes != nil && len(splitList(*p.AcceptRoutes)) > 0
+}
+
+// EditUser 按 patch 修改用户，返回修改前后的客户端配置。
+// 所有修改在一个事务中完成，任一字段不合法时不做任何修改
+func (um *UserManager) EditUser(serverConfig ServerConfig, userID string, patch UserPatch) (string, string, error) {
+	columns, err := patch.columns()
+	if err != nil {
+		return "", "", err
+	}
+
+	var before, after string
+	err = um.db.Transaction(func(tx *gorm.DB) error {
+		txum := um.withDB(tx)
+		user, err := txum.GetUser(userID)
+		if err != nil {
+			return err
+		}
+		if user.AcceptAllRoutes && patch.AcceptAllRoutes == nil && patch.acceptsRoutes() {
+			return fmt.Errorf("%w: %s accepts all routes, unset accept_all_routes to accept selected routes", ErrInvalidUpdate, userID)
+		}
+		if before, _, err = txum.renderUserConfig(serverConfig, *user); err != nil {
+			return err
+		}
+
+		if len(columns) > 0 {
+			if err := txum.users().Where("id = ?", user.ID).Updates(columns).Error; err != nil {
+				return err
+			}
+		}
+		if patch.AdvertiseRoutes != nil {
+			if err := txum.replaceAdvertisedRoutes(serverConfig, user, *patch.AdvertiseRoutes); err != nil {
+				return err
+			}
+		}
+		if patch.AcceptRoutes != nil {
+			if err := txum.replaceAcceptedRoutes(user, *patch.AcceptRoutes); err != nil {
+				return err
+			}
+		}
+
+		updated, err := txum.GetUser(userID)
+		if err != nil {
+			return err
+		}
+		after, _, err = txum.renderUserConfig(serverConfig, *updated)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return before, after, um.applyUser(userID)
+}
+
+// replaceAdvertisedRoutes 将用户广播的路由替换为 prefixes，保留的路由不变，删除的路由同时取消其他用户的接受
+func (um *UserManager) replaceAdvertisedRoutes(serverConfig ServerConfig, user *User, prefixes string) error {
+	keep := make(map[string]bool)
+	var added []Route
+	for _, route := range newRoutes(prefixes) {
+		prefix, err := parseRoute(route.Prefix)
+		if err != nil {
+			return err
+		}
+		route.Prefix = prefix.String()
+		if keep[route.Prefix] {
+			continue
+		}
+		keep[route.Prefix] = true
+		added = append(added, route)
+	}
+
+	existing := make(map[string]bool)
+	for _, route := range user.AdvertisedRoutes {
+		if keep[route.Prefix] {
+			existing[route.Prefix] = true
+			continue
+		}
+		if err := um.db.Exec("DELETE FROM user_accepted_routes WHERE route_id = ?", route.ID).Error; err != nil {
+			return err
+		}
+		if err := um.db.Delete(&Route{}, route.ID).Error; err != nil {
+			return err
+		}
+	}
+
+	routes := added[:0]
+	for _, route := range added {
+		if !existing[route.Prefix] {
+			routes = append(routes, route)
+		}
+	}
+	if err := um.checkNewRoutes(serverConfig, user.UserID, routes); err != nil {
+		return err
+	}
+	for _, route := range routes {
+		route.OwnerID = user.ID
+		if err := um.db.Create(&route).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceAcceptedRoutes 将用户接受的路由替换为 selectors 选择的路由
+func (um *UserManager) replaceAcceptedRoutes(user *User, selectors string) error {
+	routes, err := um.SelectRoutes(splitList(selectors))
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if route.OwnerID == user.ID {
+			return fmt.Errorf("%w: %s is advertised by %s itself", ErrInvalidRoute, route.Prefix, user.UserID)
+		}
+	}
+	if err := um.db.Exec("DELETE FROM user_accepted_routes WHERE user_id = ?", user.ID).Error; err != nil {
+		return err
+	}
+	for _, route := range routes {
+		err := um.db.Exec("INSERT OR IGNORE INTO user_accepted_routes (user_id, route_id) VALUES (?, ?)", user.ID, route.ID).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffLines 逐行比较两份配置，只输出删除（-）和新增（+）的行
+func diffLines(before, after string) string {
+	a := strings.Split(strings.TrimSuffix(before, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(after, "\n"), "\n")
+
+	// lcs[i][j] 是 a[i:] 与 b[j:] 的最长公共子序列长度
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			sb.WriteString("-" + a[i] + "\n")
+			i++
+		default:
+			sb.WriteString("+" + b[j] + "\n")
+			j++
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// newEditTestUserManager 添加广播两条路由的 site-a 和接受其路由的 laptop
+func newEditTestUserManager(t *testing.T) *UserManager {
+	t.Helper()
+	um := newTestUserManager(t)
+	if err := um.AddUser(testServerConfig, &User{UserID: "site-a", AdvertisedRoutes: newRoutes("10.1.0.0/16,10.2.0.0/16")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.AddUser(testServerConfig, &User{UserID: "laptop", PostUp: "ip route add 10.9.0.0/16 dev wg0 typo", PersistentKeepalive: 25}); err != nil {
+		t.Fatal(err)
+	}
+	owner := "site-a"
+	if _, _, err := um.EditUser(testServerConfig, "laptop", UserPatch{AcceptRoutes: &owner}); err != nil {
+		t.Fatal(err)
+	}
+	return um
+}
+
+func TestEditUserDiff(t *testing.T) {
+	um := newEditTestUserManager(t)
+
+	postUp := "ip route add 10.9.0.0/16 dev wg0"
+	keepalive := 0
+	before, after, err := um.EditUser(testServerConfig, "laptop", UserPatch{PostUp: &postUp, PersistentKeepalive: &keepalive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-PostUp = ip route add 10.9.0.0/16 dev wg0 typo\n+PostUp = ip route add 10.9.0.0/16 dev wg0\n-PersistentKeepalive = 25\n"
+	if diff := diffLines(before, after); diff != want {
+		t.Errorf("diff =\n%s\nwant\n%s", diff, want)
+	}
+}
+
+func TestEditUserInvalidPatch(t *testing.T) {
+	allowedIPs := "0.0.0.0/0"
+	endpoint := "vpn.example.com"
+	accept := "10.1.0.0/16,10.8.0.0/16"
+	owner := "site-a"
+	acceptAll := true
+
+	// 任一字段不合法时不做任何修改
+	tests := []struct {
+		name  string
+		patch UserPatch
+		want  error
+	}{
+		{"invalid endpoint", UserPatch{AllowedIPs: &allowedIPs, Endpoint: &endpoint}, ErrInvalidUpdate},
+		{"unknown route", UserPatch{AllowedIPs: &allowedIPs, AcceptRoutes: &accept}, ErrRouteNotFound},
+		{"accept_routes with accept_all_routes", UserPatch{AcceptAllRoutes: &acceptAll, AcceptRoutes: &owner}, ErrInvalidUpdate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			um := newEditTestUserManager(t)
+			if _, _, err := um.EditUser(testServerConfig, "laptop", tt.patch); !errors.Is(err, tt.want) {
+				t.Errorf("EditUser returned %v, want %v", err, tt.want)
+			}
+			laptop, err := um.GetUser("laptop")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if laptop.AllowedIPs == allowedIPs || laptop.AcceptAllRoutes || len(laptop.AcceptedRoutes) != 2 {
+				t.Errorf("failed edit changed the user: %+v", laptop)
+			}
+		})
+	}
+}
+
+func TestEditUserAcceptAllRoutes(t *testing.T) {
+	um := newEditTestUserManager(t)
+	owner := "site-a"
+	acceptAll := true
+
+	// 已接受全部路由的用户需要同时取消订阅才能指定路由
+	if _, _, err := um.EditUser(testServerConfig, "laptop", UserPatch{AcceptAllRoutes: &acceptAll}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := um.EditUser(testServerConfig, "laptop", UserPatch{AcceptRoutes: &owner}); !errors.Is(err, ErrInvalidUpdate) {
+		t.Errorf("EditUser with accept_routes for a subscribed user returned %v, want ErrInvalidUpdate", err)
+	}
+	acceptAll = false
+	if _, _, err := um.EditUser(testServerConfig, "laptop", UserPatch{AcceptAllRoutes: &acceptAll, AcceptRoutes: &owner}); err != nil {
+		t.Fatal(err)
+	}
+	laptop, err := um.GetUser("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if laptop.AcceptAllRoutes || len(laptop.AcceptedRoutes) != 2 {
+		t.Errorf("laptop = %+v, want site-a's two routes without accept_all_routes", laptop)
+	}
+}
+
+func TestEditUserAdvertiseRoutes(t *testing.T) {
+	um := newEditTestUserManager(t)
+
+	// 替换广播的路由，删除的路由同时从接受者的配置中移除
+	advertise := "10.1.0.0/16, 10.3.0.0/16"
+	if _, _, err := um.EditUser(testServerConfig, "site-a", UserPatch{AdvertiseRoutes: &advertise}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := um.UserConfig(testServerConfig, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "AllowedIPs = 100.10.10.3/24, 10.1.0.0/16\n") {
+		t.Errorf("laptop config after replacing site-a's routes:\n%s", config)
+	}
+
+	overlap := "10.1.0.0/16, 10.1.2.0/24"
+	var conflict *RouteConflictError
+	if _, _, err := um.EditUser(testServerConfig, "laptop", UserPatch{AdvertiseRoutes: &overlap}); !errors.As(err, &conflict) {
+		t.Errorf("advertising an overlapping route returned %v, want RouteConflictError", err)
+	}
+
+	own := "10.3.0.0/16"
+	if _, _, err := um.EditUser(testServerConfig, "site-a", UserPatch{AcceptRoutes: &own}); !errors.Is(err, ErrInvalidRoute) {
+		t.Errorf("accepting an own route returned %v, want ErrInvalidRoute", err)
+	}
+}
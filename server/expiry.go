@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidExpiry 有效期格式不正确
+var ErrInvalidExpiry = errors.New("invalid expiry")
+
+// parseExpiry 解析有效期：空或 never 表示永不过期，支持 30d、2w、12h 等时长以及 2006-01-02、RFC 3339 格式的时间
+func parseExpiry(s string, now time.Time) (*time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "never" {
+		return nil, nil
+	}
+	var expiresAt time.Time
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		expiresAt = t
+	} else if t, err := time.ParseInLocation("2006-01-02", s, now.Location()); err == nil {
+		expiresAt = t
+	} else {
+		d, err := parseValidity(s)
+		if err != nil {
+			return nil, err
+		}
+		expiresAt = now.Add(d)
+	}
+	if !expiresAt.After(now) {
+		return nil, fmt.Errorf("%w: %s is in the past", ErrInvalidExpiry, s)
+	}
+	expiresAt = expiresAt.UTC()
+	return &expiresAt, nil
+}
+
+// parseValidity 解析时长，在 time.ParseDuration 的基础上支持天（d）和周（w）
+func parseValidity(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil || count <= 0 {
+				return 0, fmt.Errorf("%w: %q", ErrInvalidExpiry, s)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidExpiry, s)
+	}
+	return d, nil
+}
+
+// Expired 判断用户在 now 时是否已过期
+func (u User) Expired(now time.Time) bool {
+	return u.ExpiresAt != nil && !u.ExpiresAt.After(now)
+}
+
+// Active 判断用户在 now 时是否可以连接：未被禁用且未过期
+func (u User) Active(now time.Time) bool {
+	return !u.Disabled && !u.Expired(now)
+}
+
+// activeUsers 过滤掉已禁用和已过期的用户
+func activeUsers(users []User, now time.Time) []User {
+	active := make([]User, 0, len(users))
+	for _, user := range users {
+		if user.Active(now) {
+			active = append(active, user)
+		}
+	}
+	return active
+}
+
+// remainingValidity 返回用户剩余的有效期，用于列表展示
+func remainingValidity(user User, now time.Time) string {
+	switch {
+	case user.ExpiresAt == nil:
+		return "never"
+	case user.Expired(now):
+		return "expired"
+	}
+	left := user.ExpiresAt.Sub(now)
+	if days := int(left.Hours()) / 24; days > 0 {
+		return fmt.Sprintf("%dd%dh", days, int(left.Hours())%24)
+	}
+	return left.Truncate(time.Minute).String()
+}
+
+// SetUserExpiry 修改用户的有效期，expiresAt 为 nil 表示永不过期。
+// 延长已过期用户的有效期时，Peer 会重新下发到接口
+func (um *UserManager) SetUserExpiry(userID string, expiresAt *time.Time) error {
+	result := um.users().Where("user_id = ?", userID).Update("expires_at", expiresAt)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return um.applyUser(userID)
+}
+
+// ExpiredUsers 返回当前接口上已过期的用户
+func (um *UserManager) ExpiredUsers() ([]User, error) {
+	var users []User
+	err := um.users().Where("expires_at IS NOT NULL").Order("user_id").Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	expired := users[:0]
+	for _, user := range users {
+		if user.Expired(now) {
+			expired = append(expired, user)
+		}
+	}
+	return expired, nil
+}
+
+// ReapExpired 从接口上删除过期用户的 Peer，deleteUsers 时同时删除用户并释放地址
+func (um *UserManager) ReapExpired(deleteUsers bool) ([]User, error) {
+	users, err := um.ExpiredUsers()
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	if deleteUsers {
+		var applyErr error
+		for _, user := range users {
+			err := um.DeleteUser(user.UserID)
+			var e *ApplyError
+			if errors.As(err, &e) {
+				applyErr = err
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return users, applyErr
+	}
+
+	var peers []wgtypes.PeerConfig
+	for _, user := range users {
+		peer, err := removePeerConfig(user.PublicKey)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return users, um.applyPeers(peers...)
+}
+
+// reapExpired 每隔 interval 处理所有接口上过期的用户，直到 stop 关闭。
+// 接口名即 WireGuard 设备名
+func (ctrl *Controller) reapExpired(interval time.Duration, deleteUsers bool, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// 只在用户第一次被处理、接口第一次下发失败时记录日志
+	var reaped map[string]bool
+	failing := make(map[string]bool)
+	for {
+		current := make(map[string]bool)
+		fileConfig := ctrl.ServerConfig()
+		configs, err := ctrl.userManager.AllInterfaceConfigs(&fileConfig)
+		if err != nil {
+			log.Printf("failed to list interfaces for expiry: %v", err)
+		}
+		for _, config := range configs {
+			users, err := ctrl.userManager.ForInterface(config.Name).WithDevice(config.Name).ReapExpired(deleteUsers)
+			for _, user := range users {
+				key := config.Name + "/" + user.UserID
+				current[key] = true
+				if !reaped[key] {
+					log.Printf("user %s on %s expired at %s", user.UserID, config.Name, user.ExpiresAt.Format(time.RFC3339))
+				}
+			}
+			if err != nil && !failing[config.Name] {
+				log.Printf("failed to remove expired peers on %s: %v", config.Name, err)
+			}
+			failing[config.Name] = err != nil
+		}
+		reaped = current
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
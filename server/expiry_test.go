@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"never", ""},
+		{"30d", "2025-03-31T12:00:00Z"},
+		{"2w", "2025-03-15T12:00:00Z"},
+		{"36h", "2025-03-03T00:00:00Z"},
+		{"2025-04-01", "2025-04-01T00:00:00Z"},
+		{"2025-04-01T08:00:00+08:00", "2025-04-01T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		got, err := parseExpiry(tt.in, now)
+		if err != nil {
+			t.Errorf("parseExpiry(%q) returned %v", tt.in, err)
+			continue
+		}
+		if (got == nil) != (tt.want == "") || (got != nil && got.Format(time.RFC3339) != tt.want) {
+			t.Errorf("parseExpiry(%q) = %v, want %s", tt.in, got, tt.want)
+		}
+	}
+	for _, in := range []string{"0d", "-1h", "30x", "d", "2025-02-01"} {
+		if _, err := parseExpiry(in, now); !errors.Is(err, ErrInvalidExpiry) {
+			t.Errorf("parseExpiry(%q) returned %v, want ErrInvalidExpiry", in, err)
+		}
+	}
+}
+
+func TestReapExpired(t *testing.T) {
+	um := newTestUserManager(t)
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(24 * time.Hour)
+	for _, user := range []*User{
+		{UserID: "alice"},
+		{UserID: "contractor", ExpiresAt: &past},
+		{UserID: "intern", ExpiresAt: &future},
+	} {
+		if err := um.AddUser(testServerConfig, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serverConf, err := um.GenerateServerConfig(testServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(serverConf, "[Peer]") != 2 || strings.Contains(serverConf, "100.10.10.3/32") {
+		t.Errorf("server config contains the expired peer:\n%s", serverConf)
+	}
+	contractor, err := um.GetUser("contractor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := *contractor
+	expired.PublicKey = key.PublicKey().String()
+	if peer, err := peerConfig(expired); err != nil || !peer.Remove {
+		t.Errorf("peer config for the expired user = %+v, %v, want removal", peer, err)
+	}
+	if got := remainingValidity(*contractor, time.Now()); got != "expired" {
+		t.Errorf("remaining validity = %s, want expired", got)
+	}
+
+	users, err := um.ReapExpired(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].UserID != "contractor" {
+		t.Errorf("reaped %v, want contractor", users)
+	}
+	if _, err := um.GetUser("contractor"); err != nil {
+		t.Errorf("contractor was deleted without deleteUsers: %v", err)
+	}
+
+	// 延长有效期后恢复
+	if err := um.SetUserExpiry("contractor", &future); err != nil {
+		t.Fatal(err)
+	}
+	if users, err := um.ExpiredUsers(); err != nil || len(users) != 0 {
+		t.Errorf("expired users after extending = %v, %v", users, err)
+	}
+	if err := um.SetUserExpiry("contractor", &past); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := um.ReapExpired(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.GetUser("contractor"); err == nil {
+		t.Error("contractor still exists after deleting expired users")
+	}
+	if remaining, err := um.GetAllUsers(); err != nil || len(remaining) != 2 {
+		t.Errorf("remaining users = %v, %v, want alice and intern", remaining, err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrGroupNotFound 分组不存在
+var ErrGroupNotFound = errors.New("group not found")
+
+// ErrGroupExists 分组名已被使用
+var ErrGroupExists = errors.New("group already exists")
+
+// Group 是一组用户，访问控制策略按分组授权。分组不属于某个接口，成员可以来自不同接口
+type Group struct {
+	ID          uint      `gorm:"primaryKey" json:"-"`
+	Name        string    `gorm:"uniqueIndex;not null" json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	Members     []User    `gorm:"many2many:group_members" json:"-"`
+}
+
+// CreateGroup 创建分组
+func (um *UserManager) CreateGroup(name string, description string) (*Group, error) {
+	if name == "" {
+		return nil, errors.New("group name is required")
+	}
+	group := Group{Name: name, Description: description}
+	err := um.db.Create(&group).Error
+	if uniqueViolation(err, "groups.name") {
+		return nil, fmt.Errorf("%w: %s", ErrGroupExists, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// InGroup 返回只操作 name 分组成员的 UserManager，用于按分组查看和批量操作
+func (um *UserManager) InGroup(name string) (*UserManager, error) {
+	if _, err := um.findGroup(name); err != nil {
+		return nil, err
+	}
+	scoped := *um
+	scoped.group = name
+	return &scoped, nil
+}
+
+// DeleteGroup 删除分组，仍被策略规则引用的分组不能删除
+func (um *UserManager) DeleteGroup(name string) error {
+	group, err := um.findGroup(name)
+	if err != nil {
+		return err
+	}
+	var count int64
+	err = um.db.Model(&PolicyRule{}).Where("group_id = ? OR destination = ?", group.ID, name).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("group %s is still used by %d policy rules", name, count)
+	}
+	return um.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM group_members WHERE group_id = ?", group.ID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Group{}, group.ID).Error
+	})
+}
+
+// findGroup 按名称查找分组
+func (um *UserManager) findGroup(name string) (*Group, error) {
+	var group Group
+	err := um.db.Where("name = ?", name).First(&group).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrGroupNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// AddGroupMembers 将当前接口上的用户加入分组
+func (um *UserManager) AddGroupMembers(name string, userIDs []string) error {
+	group, err := um.findGroup(name)
+	if err != nil {
+		return err
+	}
+	return um.db.Transaction(func(tx *gorm.DB) error {
+		for _, userID := range userIDs {
+			user, err := um.withDB(tx).GetUser(userID)
+			if err != nil {
+				return fmt.Errorf("user %s: %w", userID, err)
+			}
+			err = tx.Exec("INSERT OR IGNORE INTO group_members (group_id, user_id) VALUES (?, ?)", group.ID, user.ID).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveGroupMembers 将当前接口上的用户移出分组
+func (um *UserManager) RemoveGroupMembers(name string, userIDs []string) error {
+	group, err := um.findGroup(name)
+	if err != nil {
+		return err
+	}
+	return um.db.Transaction(func(tx *gorm.DB) error {
+		for _, userID := range userIDs {
+			user, err := um.withDB(tx).GetUser(userID)
+			if err != nil {
+				return fmt.Errorf("user %s: %w", userID, err)
+			}
+			err = tx.Exec("DELETE FROM group_members WHERE group_id = ? AND user_id = ?", group.ID, user.ID).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListGroups 返回所有分组及其在当前接口上的成员
+func (um *UserManager) ListGroups() ([]Group, error) {
+	var groups []Group
+	err := um.db.Preload("Members", "interface = ?", um.iface).Order("name").Find(&groups).Error
+	return groups, err
+}
+
+// groupNames 返回分组名
+func groupNames(groups []Group) []string {
+	names := make([]string, 0, len(groups))
+	for _, group := range groups {
+		names = append(names, group.Name)
+	}
+	return names
+}
+
+// groupMembers 返回分组在当前接口上的成员，同时加载成员广播的路由
+func (um *UserManager) groupMembers(groupID uint) ([]User, error) {
+	var members []User
+	err := um.users().Preload("AdvertisedRoutes").
+		Where("id IN (SELECT user_id FROM group_members WHERE group_id = ?)", groupID).
+		Order("user_id").Find(&members).Error
+	return members, err
+}
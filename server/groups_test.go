@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestGroupScoping(t *testing.T) {
+	um := newTestUserManager(t)
+
+	for _, id := range []string{"alice", "bob", "carol"} {
+		if err := um.AddUser(testServerConfig, &User{UserID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for group, members := range map[string][]string{"contractors": {"alice", "carol"}, "laptops": {"alice"}} {
+		if _, err := um.CreateGroup(group, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := um.AddGroupMembers(group, members); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := um.AddGroupMembers("laptops", []string{"nobody"}); err == nil {
+		t.Error("added an unknown user to a group")
+	}
+
+	contractors, err := um.InGroup("contractors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := contractors.GetAllUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].UserID != "alice" || users[1].UserID != "carol" {
+		t.Errorf("contractors = %v, want alice and carol", users)
+	}
+	if _, err := contractors.GetUser("bob"); err == nil {
+		t.Error("bob is visible through the contractors group")
+	}
+	if _, err := um.InGroup("nobody"); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("InGroup(nobody) returned %v, want ErrGroupNotFound", err)
+	}
+
+	view, err := um.GetUserView("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(view.Groups, ",") != "contractors,laptops" {
+		t.Errorf("alice is in %v", view.Groups)
+	}
+
+	// 删除分组成员，分组外的用户不受影响
+	if err := contractors.DeleteUser("bob"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("deleting bob through the contractors group returned %v, want ErrRecordNotFound", err)
+	}
+	if _, err := um.GetUser("bob"); err != nil {
+		t.Errorf("bob was deleted through the contractors group: %v", err)
+	}
+	if err := contractors.DeleteUser("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.RemoveGroupMembers("contractors", []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if users, err := contractors.GetAllUsers(); err != nil || len(users) != 0 {
+		t.Errorf("contractors = %v, %v, want no members", users, err)
+	}
+
+	if _, err := um.AddPolicyRule("laptops", "10.1.0.0/16", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.DeleteGroup("laptops"); err == nil {
+		t.Error("deleted a group used by a policy rule")
+	}
+	if err := um.DeleteGroup("contractors"); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := um.ListGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].Name != "laptops" || len(groups[0].Members) != 1 {
+		t.Errorf("groups = %+v, want laptops with alice", groups)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// defaultInterface server.yaml 未指定 name 时的接口名
+const defaultInterface = "wg0"
+
+// InterfaceName 返回 server.yaml 描述的接口名
+func (c ServerConfig) InterfaceName() string {
+	if c.Name == "" {
+		return defaultInterface
+	}
+	return c.Name
+}
+
+// ServerConfig 将数据库中的接口转换为生成配置使用的 ServerConfig
+func (i Interface) ServerConfig() ServerConfig {
+	return ServerConfig{
+		Name:         i.Name,
+		ServerIP:     i.ServerIP,
+		Port:         i.Port,
+		PrivateKey:   i.PrivateKey,
+		PublicKey:    i.PublicKey,
+		IP:           i.IP,
+		DNS:          i.DNS,
+		Table:        i.Table,
+		MTU:          i.MTU,
+		PreUp:        i.PreUp,
+		PostUp:       i.PostUp,
+		PreDown:      i.PreDown,
+		PostDown:     i.PostDown,
+		IPPool:       i.IPPool,
+		IPv6:         i.IPv6,
+		IPPoolV6:     i.IPPoolV6,
+		Reserved:     splitList(i.Reserved),
+		IPQuarantine: i.IPQuarantine,
+	}
+}
+
+// CreateInterface 保存新接口，未提供私钥时自动生成密钥对
+func (um *UserManager) CreateInterface(iface *Interface) error {
+	if iface.Name == "" {
+		return errors.New("interface name is required")
+	}
+	if iface.Port == 0 {
+		return errors.New("interface listen port is required")
+	}
+	if _, _, err := net.ParseCIDR(iface.IP); err != nil {
+		return fmt.Errorf("invalid interface address: %w", err)
+	}
+	if _, _, err := net.ParseCIDR(iface.IPPool); err != nil {
+		return fmt.Errorf("invalid ip pool: %w", err)
+	}
+	if iface.IPv6 != "" {
+		if _, _, err := net.ParseCIDR(iface.IPv6); err != nil {
+			return fmt.Errorf("invalid interface IPv6 address: %w", err)
+		}
+	}
+	if iface.IPPoolV6 != "" {
+		if err := validatePoolV6(iface.IPPoolV6); err != nil {
+			return err
+		}
+	}
+	for _, entry := range splitList(iface.Reserved) {
+		if _, err := parseAddrRange(entry); err != nil {
+			return err
+		}
+	}
+	if _, err := iface.ServerConfig().quarantine(); err != nil {
+		return err
+	}
+
+	if iface.PrivateKey == "" {
+		privateKey, publicKey, err := um.keys.GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+		iface.PrivateKey = privateKey
+		iface.PublicKey = publicKey
+	}
+
+	sealed := *iface
+	var err error
+	if sealed.PrivateKey, err = um.sealer.Seal(sealed.PrivateKey); err != nil {
+		return err
+	}
+	if err := um.db.Create(&sealed).Error; err != nil {
+		return err
+	}
+	iface.ID = sealed.ID
+	return nil
+}
+
+func (um *UserManager) GetInterface(name string) (*Interface, error) {
+	var iface Interface
+	err := um.db.Where("name = ?", name).First(&iface).Error
+	if err != nil {
+		return nil, err
+	}
+	return &iface, nil
+}
+
+func (um *UserManager) ListInterfaces() ([]Interface, error) {
+	var ifaces []Interface
+	err := um.db.Order("name").Find(&ifaces).Error
+	return ifaces, err
+}
+
+// DeleteInterface 删除接口，接口下仍有用户时拒绝
+func (um *UserManager) DeleteInterface(name string) error {
+	var count int64
+	err := um.db.Model(&User{}).Where("interface = ?", name).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("interface %s still has %d users", name, count)
+	}
+	result := um.db.Where("name = ?", name).Delete(&Interface{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return um.db.Where("interface = ?", name).Delete(&PolicyRule{}).Error
+}
+
+// InterfaceConfig 返回当前接口的配置。fileConfig 是 server.yaml 的内容，
+// 其描述的接口直接使用文件中的配置，其余接口从数据库读取
+func (um *UserManager) InterfaceConfig(fileConfig *ServerConfig) (*ServerConfig, error) {
+	if fileConfig != nil && fileConfig.InterfaceName() == um.iface {
+		config := *fileConfig
+		config.Name = um.iface
+		return &config, nil
+	}
+	iface, err := um.GetInterface(um.iface)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("interface %s not found", um.iface)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := iface.ServerConfig()
+	return &config, nil
+}
+
+// AllInterfaceConfigs 返回 server.yaml 和数据库中所有接口的配置
+func (um *UserManager) AllInterfaceConfigs(fileConfig *ServerConfig) ([]ServerConfig, error) {
+	var configs []ServerConfig
+	if fileConfig != nil {
+		config := *fileConfig
+		config.Name = fileConfig.InterfaceName()
+		configs = append(configs, config)
+	}
+	ifaces, err := um.ListInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		if fileConfig != nil && iface.Name == fileConfig.InterfaceName() {
+			continue
+		}
+		configs = append(configs, iface.ServerConfig())
+	}
+	return configs, nil
+}
+
+// splitList 拆分逗号分隔的列表，忽略空项
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
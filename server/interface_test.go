@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestInterfaceScoping(t *testing.T) {
+	um := newTestUserManager(t)
+
+	err := um.CreateInterface(&Interface{Name: "wg1", Port: 51821, IP: "100.20.20.1/24", IPPool: "100.20.20.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg1 := um.ForInterface("wg1")
+	wg1Config, err := wg1.InterfaceConfig(&testServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wg1Config.Port != 51821 || wg1Config.PublicKey == "" {
+		t.Errorf("unexpected wg1 config %+v", wg1Config)
+	}
+
+	if err := um.AddUser(testServerConfig, &User{UserID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	site := &User{UserID: "site-a"}
+	if err := wg1.AddUser(*wg1Config, site); err != nil {
+		t.Fatal(err)
+	}
+	if site.Interface != "wg1" || site.IP != "100.20.20.2" {
+		t.Errorf("site-a got interface %s ip %s, want wg1 100.20.20.2", site.Interface, site.IP)
+	}
+
+	if _, err := wg1.GetUser("alice"); err == nil {
+		t.Error("alice is visible on wg1")
+	}
+	users, err := um.GetAllUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].UserID != "alice" {
+		t.Errorf("wg0 users = %v, want [alice]", users)
+	}
+
+	if err := um.DeleteInterface("wg1"); err == nil {
+		t.Error("deleted interface wg1 while it still has users")
+	}
+	if err := wg1.DeleteUser("site-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.DeleteInterface("wg1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInterfaceUniqueness(t *testing.T) {
+	um := newTestUserManager(t)
+
+	// wg1 与 wg0 共用地址池
+	err := um.CreateInterface(&Interface{Name: "wg1", Port: 51821, IP: "100.10.10.1/24", IPPool: "100.10.10.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg1 := um.ForInterface("wg1")
+	wg1Config, err := wg1.InterfaceConfig(&testServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := um.AddUser(testServerConfig, &User{UserID: "site-a", AdvertisedRoutes: newRoutes("10.1.0.0/16")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 用户 ID 只需在接口内唯一
+	site := &User{UserID: "site-a"}
+	if err := wg1.AddUser(*wg1Config, site); err != nil {
+		t.Fatalf("adding site-a on wg1: %v", err)
+	}
+	if site.IP != "100.10.10.3" {
+		t.Errorf("site-a on wg1 got %s, want 100.10.10.3", site.IP)
+	}
+	if err := wg1.AddUser(*wg1Config, &User{UserID: "site-a"}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("adding site-a twice on wg1 returned %v, want ErrUserExists", err)
+	}
+	for _, tc := range []struct {
+		um *UserManager
+		ip string
+	}{{um, "100.10.10.2"}, {wg1, "100.10.10.3"}} {
+		user, err := tc.um.GetUser("site-a")
+		if err != nil || user.IP != tc.ip {
+			t.Errorf("site-a on %s = %+v, %v, want ip %s", tc.um.Interface(), user, err, tc.ip)
+		}
+	}
+
+	// 地址和路由在所有接口上唯一
+	if err := wg1.AddUser(*wg1Config, &User{UserID: "static", IP: "100.10.10.2"}); !errors.Is(err, ErrAddressUnavailable) {
+		t.Errorf("reusing wg0's address on wg1 returned %v, want ErrAddressUnavailable", err)
+	}
+	var conflict *RouteConflictError
+	if err := wg1.AddUser(*wg1Config, &User{UserID: "site-b", AdvertisedRoutes: newRoutes("10.1.0.0/16")}); !errors.As(err, &conflict) {
+		t.Errorf("advertising wg0's route on wg1 returned %v, want RouteConflictError", err)
+	}
+
+	// 删除只作用于当前接口
+	if err := wg1.DeleteUser("site-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.GetUser("site-a"); err != nil {
+		t.Errorf("deleting site-a on wg1 removed it from wg0: %v", err)
+	}
+}
+
+func TestMigrateUserIDIndex(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "users.db")
+	um := openTestUserManager(t, dbPath)
+	// 模拟旧版本的全局唯一索引
+	if err := um.db.Exec("CREATE UNIQUE INDEX idx_users_user_id ON users(user_id)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	um = openTestUserManager(t, dbPath)
+	if um.db.Migrator().HasIndex(&User{}, "idx_users_user_id") {
+		t.Error("the global user_id index was not dropped")
+	}
+	if err := um.CreateInterface(&Interface{Name: "wg1", Port: 51821, IP: "100.20.20.1/24", IPPool: "100.20.20.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	wg1 := um.ForInterface("wg1")
+	wg1Config, err := wg1.InterfaceConfig(&testServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := um.AddUser(testServerConfig, &User{UserID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wg1.AddUser(*wg1Config, &User{UserID: "alice"}); err != nil {
+		t.Errorf("adding alice on wg1 after the migration: %v", err)
+	}
+}
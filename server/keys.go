@@ -0,0 +1,30 @@
+package main
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// KeyGenerator 生成 WireGuard 密钥，测试时可以注入固定的密钥
+type KeyGenerator interface {
+	GenerateKeyPair() (privateKey string, publicKey string, err error)
+	GeneratePresharedKey() (string, error)
+}
+
+// wgKeyGenerator 使用 wgtypes 生成密钥，不依赖 wg 命令
+type wgKeyGenerator struct{}
+
+func (wgKeyGenerator) GenerateKeyPair() (string, string, error) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return "", "", err
+	}
+	return key.String(), key.PublicKey().String(), nil
+}
+
+func (wgKeyGenerator) GeneratePresharedKey() (string, error) {
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	return key.String(), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// staticKeyGenerator 按顺序返回固定的密钥
+type staticKeyGenerator struct {
+	n int
+}
+
+func (g *staticKeyGenerator) GenerateKeyPair() (string, string, error) {
+	g.n++
+	return fmt.Sprintf("private-%d", g.n), fmt.Sprintf("public-%d", g.n), nil
+}
+
+func (g *staticKeyGenerator) GeneratePresharedKey() (string, error) {
+	g.n++
+	return fmt.Sprintf("psk-%d", g.n), nil
+}
+
+func TestWgKeyGenerator(t *testing.T) {
+	privateKey, publicKey, err := wgKeyGenerator{}.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := wgtypes.ParseKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.PublicKey().String() != publicKey {
+		t.Errorf("public key %s does not match private key", publicKey)
+	}
+}
+
+func TestAddUserWithKeyGenerator(t *testing.T) {
+	um := newTestUserManager(t)
+
+	user := &User{UserID: "alice"}
+	if err := um.AddUser(testServerConfig, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.PrivateKey != "private-1" || user.PublicKey != "public-1" {
+		t.Errorf("got keys %s/%s, want private-1/public-1", user.PrivateKey, user.PublicKey)
+	}
+}
+
+func TestAddUserWithClientPublicKey(t *testing.T) {
+	um := newTestUserManager(t)
+
+	key, _ := wgtypes.GeneratePrivateKey()
+	user := &User{UserID: "bob", PublicKey: key.PublicKey().String()}
+	if err := um.AddUser(testServerConfig, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.PrivateKey != "" {
+		t.Errorf("private key %q stored for client-supplied public key", user.PrivateKey)
+	}
+	config := generateUserConfig(ServerConfig{}, *user)
+	if !strings.Contains(config, "PrivateKey = "+privateKeyPlaceholder) {
+		t.Errorf("config does not contain private key placeholder:\n%s", config)
+	}
+
+	if err := um.AddUser(testServerConfig, &User{UserID: "mallory", PublicKey: "not-a-key"}); err == nil {
+		t.Error("expected invalid public key to be rejected")
+	}
+}
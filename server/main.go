@@ -11,8 +11,9 @@ import (
 
 func main() {
 	var rootCmd = &cobra.Command{Use: "vpn-tool"}
+	addPathFlags(rootCmd)
 
-	rootCmd.AddCommand(Setup(), Add(), Delete(), Get(), GetAllUsers(), Server(), UpdateEndpoints(), Info())
+	rootCmd.AddCommand(Setup(), Add(), Delete(), Get(), GetAllUsers(), Server(), UpdateEndpoints(), Info(), RotatePSK(), RotateKey(), RotateServerKey(), MigrateEncrypt(), Token(), InterfaceCmd(), RouteCmd(), GroupCmd(), PolicyCmd(), Expire(), Disable(), Enable(), EditUser())
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -8,6 +8,7 @@ import (
 )
 
 type ServerConfig struct {
+	Name       string `yaml:"name"` // 接口名，默认为 wg0
 	ServerIP   string `yaml:"server_ip"`
 	Port       int    `yaml:"port"`
 	PrivateKey string `yaml:"private_key"`
@@ -21,23 +22,165 @@ type ServerConfig struct {
 	PreDown    string `yaml:"pre_down"`
 	PostDown   string `yaml:"post_down"`
 	IPPool     string `yaml:"ip_pool"`
+	IPv6       string `yaml:"ip_v6"`      // 可选，接口的 IPv6 地址，如 fd00:10::1/64
+	IPPoolV6   string `yaml:"ip_pool_v6"` // 可选，配置后每个用户额外分配一个 IPv6 地址
+	// 不参与自动分配的地址，支持单个地址、CIDR 和 "起始地址-结束地址"，可以通过 --ip 静态指定
+	Reserved []string `yaml:"reserved"`
+	// 删除用户后地址在这段时间内不会被自动分配，如 "168h"，为空时立即重用
+	IPQuarantine string `yaml:"ip_quarantine"`
+}
+
+// Interface 是保存在数据库中的 WireGuard 接口，字段与 ServerConfig 对应
+type Interface struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	Name         string    `gorm:"uniqueIndex;not null" json:"name"`
+	ServerIP     string    `json:"server_ip"`
+	Port         int       `gorm:"not null" json:"port"`
+	PrivateKey   string    `gorm:"not null" json:"-"`
+	PublicKey    string    `gorm:"not null" json:"public_key"`
+	IP           string    `gorm:"not null" json:"ip"`
+	DNS          string    `json:"dns"`
+	Table        string    `json:"table"`
+	MTU          int       `json:"mtu"`
+	PreUp        string    `json:"pre_up"`
+	PostUp       string    `json:"post_up"`
+	PreDown      string    `json:"pre_down"`
+	PostDown     string    `json:"post_down"`
+	IPPool       string    `gorm:"not null" json:"ip_pool"`
+	IPv6         string    `gorm:"column:ipv6" json:"ipv6"`
+	IPPoolV6     string    `gorm:"column:ip_pool_v6" json:"ip_pool_v6"`
+	Reserved     string    `json:"reserved"` // 逗号分隔
+	IPQuarantine string    `json:"ip_quarantine"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 type User struct {
-	ID                  uint   `gorm:"primaryKey"`
-	UserID              string `gorm:"uniqueIndex;not null" json:"user_id"`
-	PublicKey           string `gorm:"not null" json:"public_key"`
-	PrivateKey          string `gorm:"not null" json:"private_key"`
-	IP                  string `gorm:"uniqueIndex;not null" json:"ip"`
-	AllowedIPs          string `gorm:"not null" json:"allowed_ips"`
-	Endpoint            string `gorm:"not null" json:"endpoint"`
-	PersistentKeepalive int    `json:"persistent_keepalive"`
-	PreUp               string `json:"pre_up"`
-	PostUp              string `json:"post_up"`
-	PreDown             string `json:"pre_down"`
-	PostDown            string `json:"post_down"`
-	AdvertiseRoutes     string `json:"advertise_routes"`
-	AcceptRoutes        string `json:"accept_routes"`
+	ID                  uint       `gorm:"primaryKey"`
+	UserID              string     `gorm:"uniqueIndex:idx_users_interface_user_id,priority:2;not null" json:"user_id"` // 在接口内唯一
+	Interface           string     `gorm:"index;uniqueIndex:idx_users_interface_user_id,priority:1;not null;default:wg0" json:"interface"`
+	PublicKey           string     `gorm:"not null" json:"public_key"`
+	PrivateKey          string     `gorm:"not null" json:"-"`
+	PresharedKey        string     `json:"-"`
+	IP                  string     `gorm:"uniqueIndex;not null" json:"ip"`
+	IPv6                string     `gorm:"column:ipv6;uniqueIndex:idx_users_ipv6_unique,where:ipv6 != ''" json:"ipv6"` // 接口未配置 IPv6 地址池时为空
+	AllowedIPs          string     `gorm:"not null" json:"allowed_ips"`
+	Endpoint            string     `gorm:"not null" json:"endpoint"`
+	PersistentKeepalive int        `json:"persistent_keepalive"`
+	PreUp               string     `json:"pre_up"`
+	PostUp              string     `json:"post_up"`
+	PreDown             string     `json:"pre_down"`
+	PostDown            string     `json:"post_down"`
+	CreatedBy           string     `json:"created_by"`                                      // 通过 API 添加时为令牌名称
+	AcceptAllRoutes     bool       `gorm:"not null;default:false" json:"accept_all_routes"` // 接受接口上当前和以后的所有路由
+	IssuedAllowedIPs    string     `json:"issued_allowed_ips"`                              // 最近一次生成的客户端配置中的 AllowedIPs
+	ExpiresAt           *time.Time `json:"expires_at"`                                      // 为空表示永不过期
+	Disabled            bool       `gorm:"not null;default:false" json:"disabled"`          // 暂停访问，保留地址、密钥和路由
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+	AdvertisedRoutes    []Route    `gorm:"foreignKey:OwnerID" json:"advertised_routes"`
+	AcceptedRoutes      []Route    `gorm:"many2many:user_accepted_routes" json:"accepted_routes"`
+	Groups              []Group    `gorm:"many2many:group_members" json:"groups"`
+}
+
+// Route 是用户广播的一个网段，其他用户可以接受该路由
+type Route struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Prefix      string    `gorm:"uniqueIndex;not null" json:"prefix"`
+	OwnerID     uint      `gorm:"index;not null" json:"-"`
+	Owner       string    `gorm:"->;-:migration" json:"owner"` // 查询时关联得到的所有者用户 ID
+	Description string    `json:"description"`
+	Enabled     bool      `gorm:"not null" json:"enabled"` // 禁用的路由不写入任何配置，但仍占用该网段
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// UserView 是 API 返回的用户信息，不包含私钥和预共享密钥
+type UserView struct {
+	UserID              string     `json:"user_id"`
+	Interface           string     `json:"interface"`
+	IP                  string     `json:"ip"`
+	IPv6                string     `json:"ipv6"`
+	PublicKey           string     `json:"public_key"`
+	AllowedIPs          string     `json:"allowed_ips"`
+	Endpoint            string     `json:"endpoint"`
+	PersistentKeepalive int        `json:"persistent_keepalive"`
+	PreUp               string     `json:"pre_up"`
+	PostUp              string     `json:"post_up"`
+	PreDown             string     `json:"pre_down"`
+	PostDown            string     `json:"post_down"`
+	AdvertiseRoutes     []string   `json:"advertise_routes"`
+	AcceptRoutes        []string   `json:"accept_routes"`
+	AcceptAllRoutes     bool       `json:"accept_all_routes"`
+	Groups              []string   `json:"groups"`
+	ExpiresAt           *time.Time `json:"expires_at"`
+	Expired             bool       `json:"expired"`
+	Disabled            bool       `json:"disabled"`
+	CreatedBy           string     `json:"created_by"`
+	HasPresharedKey     bool       `json:"has_preshared_key"`
+	ClientManagedKey    bool       `json:"client_managed_key"` // 私钥由客户端保管
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+	Online              bool       `json:"online"`
+	LastHandshake       *time.Time `json:"last_handshake"`
+}
+
+// onlineThreshold 最近一次握手在此时间内视为在线，WireGuard 每两分钟重新握手
+const onlineThreshold = 3 * time.Minute
+
+func newUserView(user User, lastHandshake time.Time) UserView {
+	view := UserView{
+		UserID:              user.UserID,
+		Interface:           user.Interface,
+		IP:                  user.IP,
+		IPv6:                user.IPv6,
+		PublicKey:           user.PublicKey,
+		AllowedIPs:          user.AllowedIPs,
+		Endpoint:            user.Endpoint,
+		PersistentKeepalive: user.PersistentKeepalive,
+		PreUp:               user.PreUp,
+		PostUp:              user.PostUp,
+		PreDown:             user.PreDown,
+		PostDown:            user.PostDown,
+		AdvertiseRoutes:     routePrefixes(user.AdvertisedRoutes, false),
+		AcceptRoutes:        routePrefixes(user.AcceptedRoutes, false),
+		AcceptAllRoutes:     user.AcceptAllRoutes,
+		Groups:              groupNames(user.Groups),
+		ExpiresAt:           user.ExpiresAt,
+		Expired:             user.Expired(time.Now()),
+		Disabled:            user.Disabled,
+		CreatedBy:           user.CreatedBy,
+		HasPresharedKey:     user.PresharedKey != "",
+		ClientManagedKey:    user.PrivateKey == "",
+		CreatedAt:           user.CreatedAt,
+		UpdatedAt:           user.UpdatedAt,
+	}
+	if !lastHandshake.IsZero() {
+		view.LastHandshake = &lastHandshake
+		view.Online = time.Since(lastHandshake) < onlineThreshold
+	}
+	return view
+}
+
+// Role 决定 API 令牌可以执行的操作
+type Role string
+
+const (
+	RoleAdmin    Role = "admin"    // 所有操作
+	RoleOperator Role = "operator" // 添加用户，删除自己添加的用户
+	RoleSelf     Role = "self"     // 只能获取绑定用户自己的信息和配置
+)
+
+// APIToken 是 API 访问令牌，数据库中只保存哈希
+type APIToken struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	Name       string     `gorm:"uniqueIndex;not null" json:"name"`
+	TokenHash  string     `gorm:"uniqueIndex;not null" json:"-"`
+	Role       Role       `gorm:"not null;default:admin" json:"role"`
+	UserID     string     `json:"user_id"`   // RoleSelf 绑定的用户
+	Interface  string     `json:"interface"` // RoleSelf 绑定用户所在的接口，旧令牌为空时不限制接口
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
 }
 
 type UserTrafficData struct {
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidPolicy 策略规则不合法
+var ErrInvalidPolicy = errors.New("invalid policy rule")
+
+// ErrPolicyRuleNotFound 当前接口上没有该规则
+var ErrPolicyRuleNotFound = errors.New("policy rule not found")
+
+// PolicyRule 允许一个分组的成员访问目标前缀或另一个分组。
+// 接口上存在规则时，从隧道进入、目标在 VPN 内（地址池和广播的路由）的流量默认丢弃，
+// 只放行规则允许的流量；访问 VPN 之外的流量不受影响
+type PolicyRule struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Interface   string    `gorm:"index;not null" json:"interface"`
+	GroupID     uint      `gorm:"index;not null" json:"-"`
+	Group       Group     `json:"group"`
+	Destination string    `gorm:"not null" json:"destination"` // CIDR 或分组名
+	Proto       string    `json:"proto"`                       // tcp、udp，为空表示任意协议
+	Ports       string    `json:"ports"`                       // 逗号分隔的端口或端口范围，如 22,8000-8080
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// portRange 闭区间 [from, to]
+type portRange struct {
+	from, to int
+}
+
+func (r portRange) String() string {
+	if r.from == r.to {
+		return strconv.Itoa(r.from)
+	}
+	return fmt.Sprintf("%d-%d", r.from, r.to)
+}
+
+var (
+	portPattern    = regexp.MustCompile(`^(\d+)(?:-(\d+))?$`)
+	nftNamePattern = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// parsePorts 解析逗号分隔的端口列表
+func parsePorts(ports string) ([]portRange, error) {
+	var ranges []portRange
+	for _, entry := range splitList(ports) {
+		m := portPattern.FindStringSubmatch(entry)
+		if m == nil {
+			return nil, fmt.Errorf("%w: bad port %q", ErrInvalidPolicy, entry)
+		}
+		from, _ := strconv.Atoi(m[1])
+		to := from
+		if m[2] != "" {
+			to, _ = strconv.Atoi(m[2])
+		}
+		if from < 1 || to > 65535 || to < from {
+			return nil, fmt.Errorf("%w: bad port %q", ErrInvalidPolicy, entry)
+		}
+		ranges = append(ranges, portRange{from: from, to: to})
+	}
+	return ranges, nil
+}
+
+// AddPolicyRule 在当前接口上添加规则，允许 group 的成员访问 destination
+func (um *UserManager) AddPolicyRule(group, destination, proto, ports, description string) (*PolicyRule, error) {
+	g, err := um.findGroup(group)
+	if err != nil {
+		return nil, err
+	}
+	if destination == "" {
+		return nil, fmt.Errorf("%w: destination is required", ErrInvalidPolicy)
+	}
+	if strings.Contains(destination, "/") {
+		prefix, err := netip.ParsePrefix(destination)
+		if err != nil {
+			return nil, fmt.Errorf("%w: destination %q: %v", ErrInvalidPolicy, destination, err)
+		}
+		destination = prefix.Masked().String()
+	} else if _, err := um.findGroup(destination); err != nil {
+		return nil, fmt.Errorf("%w: destination %q is neither a CIDR nor a group", ErrInvalidPolicy, destination)
+	}
+	proto = strings.ToLower(proto)
+	if proto != "" && proto != "tcp" && proto != "udp" {
+		return nil, fmt.Errorf("%w: proto must be tcp or udp", ErrInvalidPolicy)
+	}
+	portRanges, err := parsePorts(ports)
+	if err != nil {
+		return nil, err
+	}
+	var normalized []string
+	for _, r := range portRanges {
+		normalized = append(normalized, r.String())
+	}
+
+	rule := PolicyRule{
+		Interface:   um.iface,
+		GroupID:     g.ID,
+		Group:       *g,
+		Destination: destination,
+		Proto:       proto,
+		Ports:       strings.Join(normalized, ","),
+		Description: description,
+	}
+	if err := um.db.Omit("Group").Create(&rule).Error; err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// RemovePolicyRule 删除当前接口上的规则
+func (um *UserManager) RemovePolicyRule(id uint) error {
+	result := um.db.Where("interface = ? AND id = ?", um.iface, id).Delete(&PolicyRule{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: %d", ErrPolicyRuleNotFound, id)
+	}
+	return nil
+}
+
+// ListPolicyRules 按添加顺序返回当前接口上的规则
+func (um *UserManager) ListPolicyRules() ([]PolicyRule, error) {
+	var rules []PolicyRule
+	err := um.db.Preload("Group").Where("interface = ?", um.iface).Order("id").Find(&rules).Error
+	return rules, err
+}
+
+// compiledRule 展开分组之后的规则
+type compiledRule struct {
+	PolicyRule
+	src, dst []netip.Prefix
+	ports    []portRange
+}
+
+// compiledPolicy 是接口上的全部规则以及默认丢弃的范围
+type compiledPolicy struct {
+	scope []netip.Prefix // 地址池和启用的路由
+	rules []compiledRule
+}
+
+// compilePolicy 展开当前接口上的规则，没有规则时返回 nil
+func (um *UserManager) compilePolicy(serverConfig ServerConfig) (*compiledPolicy, error) {
+	rules, err := um.ListPolicyRules()
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+
+	policy := &compiledPolicy{}
+	for _, pool := range []string{serverConfig.IPPool, serverConfig.IPPoolV6} {
+		if pool == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(pool)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip pool %q: %w", pool, err)
+		}
+		policy.scope = append(policy.scope, prefix.Masked())
+	}
+	routes, err := um.AllRoutes()
+	if err != nil {
+		return nil, err
+	}
+	policy.scope = append(policy.scope, parsePrefixes(routePrefixes(routes, true))...)
+
+	members := make(map[uint][]netip.Prefix)
+	expand := func(groupID uint) ([]netip.Prefix, error) {
+		if prefixes, ok := members[groupID]; ok {
+			return prefixes, nil
+		}
+		users, err := um.groupMembers(groupID)
+		if err != nil {
+			return nil, err
+		}
+		var prefixes []netip.Prefix
+		for _, user := range users {
+			prefixes = append(prefixes, parsePrefixes(hostPrefixes(user))...)
+			prefixes = append(prefixes, parsePrefixes(routePrefixes(user.AdvertisedRoutes, true))...)
+		}
+		members[groupID] = prefixes
+		return prefixes, nil
+	}
+
+	for _, rule := range rules {
+		compiled := compiledRule{PolicyRule: rule}
+		compiled.src, err = expand(rule.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(rule.Destination, "/") {
+			compiled.dst = parsePrefixes([]string{rule.Destination})
+		} else {
+			dst, err := um.findGroup(rule.Destination)
+			if errors.Is(err, ErrGroupNotFound) {
+				// 目标分组已被删除，规则不再放行任何流量
+				policy.rules = append(policy.rules, compiled)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			compiled.dst, err = expand(dst.ID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		compiled.ports, _ = parsePorts(rule.Ports)
+		policy.rules = append(policy.rules, compiled)
+	}
+	return policy, nil
+}
+
+// parsePrefixes 解析前缀列表，忽略无法解析的项
+func parsePrefixes(prefixes []string) []netip.Prefix {
+	var parsed []netip.Prefix
+	for _, p := range prefixes {
+		if prefix, err := netip.ParsePrefix(p); err == nil {
+			parsed = append(parsed, prefix.Masked())
+		}
+	}
+	return parsed
+}
+
+// nftTable 返回接口对应的 nftables 表名
+func nftTable(iface string) string {
+	return "wg_mgr_" + nftNamePattern.ReplaceAllString(iface, "_")
+}
+
+// nftRules 将策略编译为 nft 命令，每行一条，可以直接作为 nft -f 的输入重复执行
+func (p *compiledPolicy) nftRules(iface string) []string {
+	table := "inet " + nftTable(iface)
+	in := fmt.Sprintf("iifname %q", iface)
+	lines := []string{
+		"add table " + table,
+		"flush table " + table,
+		"add chain " + table + " forward { type filter hook forward priority 0; policy accept; }",
+		fmt.Sprintf("add rule %s forward %s ct state established,related accept", table, in),
+	}
+	for _, rule := range p.rules {
+		for _, family := range []string{"ip", "ip6"} {
+			src := nftSet(rule.src, family)
+			dst := nftSet(rule.dst, family)
+			if src == "" || dst == "" {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("add rule %s forward %s %s saddr %s %s daddr %s%s accept comment \"rule %d\"",
+				table, in, family, src, family, dst, nftMatchPorts(rule), rule.ID))
+		}
+	}
+	for _, family := range []string{"ip", "ip6"} {
+		if scope := nftSet(p.scope, family); scope != "" {
+			lines = append(lines, fmt.Sprintf("add rule %s forward %s %s daddr %s drop", table, in, family, scope))
+		}
+	}
+	return lines
+}
+
+// nftSet 返回 family 地址族的前缀组成的匿名集合，没有该地址族的前缀时返回空字符串
+func nftSet(prefixes []netip.Prefix, family string) string {
+	var elements []string
+	for _, prefix := range prefixes {
+		if prefix.Addr().Is4() == (family == "ip") {
+			elements = append(elements, prefix.String())
+		}
+	}
+	if len(elements) == 0 {
+		return ""
+	}
+	return "{ " + strings.Join(elements, ", ") + " }"
+}
+
+func nftMatchPorts(rule compiledRule) string {
+	var ports []string
+	for _, r := range rule.ports {
+		ports = append(ports, r.String())
+	}
+	switch {
+	case len(ports) > 0 && rule.Proto != "":
+		return fmt.Sprintf(" %s dport { %s }", rule.Proto, strings.Join(ports, ", "))
+	case len(ports) > 0:
+		return fmt.Sprintf(" meta l4proto { tcp, udp } th dport { %s }", strings.Join(ports, ", "))
+	case rule.Proto != "":
+		return " meta l4proto " + rule.Proto
+	}
+	return ""
+}
+
+// GeneratePolicy 生成当前接口的 nftables 规则，没有规则时返回空字符串
+func (um *UserManager) GeneratePolicy(serverConfig ServerConfig) (string, error) {
+	policy, err := um.compilePolicy(serverConfig)
+	if err != nil || policy == nil {
+		return "", err
+	}
+	return strings.Join(policy.nftRules(um.iface), "\n") + "\n", nil
+}
+
+// policyHooks 返回加载和删除策略的 PostUp、PostDown 命令，没有规则时返回空字符串
+func (um *UserManager) policyHooks(serverConfig ServerConfig) (string, string, error) {
+	policy, err := um.compilePolicy(serverConfig)
+	if err != nil || policy == nil {
+		return "", "", err
+	}
+	up := fmt.Sprintf("nft '%s'", strings.Join(policy.nftRules(um.iface), "; "))
+	down := fmt.Sprintf("nft delete table inet %s", nftTable(um.iface))
+	return up, down, nil
+}
+
+// PolicyDecision 是一个流量在策略下的结果
+type PolicyDecision struct {
+	Allowed bool
+	Rule    *PolicyRule // 放行该流量的规则
+	Reason  string
+}
+
+// EvaluatePolicy 离线判断从用户 from 到 to（用户 ID 或 IP 地址）的流量是否被放行。
+// proto 为空表示任意协议，此时只有不限制协议和端口的规则才会放行；
+// port 为 0 表示任意端口，此时只有不限制端口的规则才会放行
+func (um *UserManager) EvaluatePolicy(serverConfig ServerConfig, from, to, proto string, port int) (*PolicyDecision, error) {
+	source, err := um.GetUser(from)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: %w", from, err)
+	}
+	dst, err := netip.ParseAddr(to)
+	if err != nil {
+		target, err := um.GetUser(to)
+		if err != nil {
+			return nil, fmt.Errorf("%s is neither an IP address nor a user: %w", to, err)
+		}
+		dst, err = netip.ParseAddr(target.IP)
+		if err != nil {
+			return nil, err
+		}
+	}
+	src, err := netip.ParseAddr(source.IP)
+	if err != nil {
+		return nil, err
+	}
+	if dst.Is6() {
+		if src, err = netip.ParseAddr(source.IPv6); err != nil {
+			return nil, fmt.Errorf("user %s has no IPv6 address", from)
+		}
+	}
+	proto = strings.ToLower(proto)
+	if proto != "" && proto != "tcp" && proto != "udp" {
+		return nil, fmt.Errorf("%w: proto must be tcp or udp", ErrInvalidPolicy)
+	}
+	if port != 0 && proto == "" {
+		return nil, fmt.Errorf("%w: a port needs a proto", ErrInvalidPolicy)
+	}
+
+	policy, err := um.compilePolicy(serverConfig)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil {
+		return &PolicyDecision{Allowed: true, Reason: "no policy rules on " + um.iface}, nil
+	}
+	if !containsAddr(policy.scope, dst) {
+		return &PolicyDecision{Allowed: true, Reason: dst.String() + " is outside the VPN"}, nil
+	}
+	for _, rule := range policy.rules {
+		if containsAddr(rule.src, src) && containsAddr(rule.dst, dst) && rule.matches(proto, port) {
+			matched := rule.PolicyRule
+			return &PolicyDecision{Allowed: true, Rule: &matched, Reason: fmt.Sprintf("allowed by rule %d", rule.ID)}, nil
+		}
+	}
+	return &PolicyDecision{Reason: fmt.Sprintf("no rule allows %s to %s", src, dst)}, nil
+}
+
+// matches 判断规则的协议和端口是否覆盖 proto、port
+func (r compiledRule) matches(proto string, port int) bool {
+	if r.Proto == "" && len(r.ports) == 0 {
+		return true
+	}
+	if proto == "" || (r.Proto != "" && r.Proto != proto) {
+		return false
+	}
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, p := range r.ports {
+		if p.from <= port && port <= p.to {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	um := newTestUserManager(t)
+
+	for _, user := range []*User{
+		{UserID: "site-a", AdvertisedRoutes: newRoutes("10.1.0.0/16")},
+		{UserID: "alice"},
+		{UserID: "bob"},
+	} {
+		if err := um.AddUser(testServerConfig, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decision, err := um.EvaluatePolicy(testServerConfig, "alice", "bob", "", 0)
+	if err != nil || !decision.Allowed {
+		t.Errorf("without rules alice to bob = %+v, %v, want allowed", decision, err)
+	}
+
+	for group, members := range map[string][]string{"devs": {"alice"}, "sites": {"site-a"}} {
+		if _, err := um.CreateGroup(group, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := um.AddGroupMembers(group, members); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := um.CreateGroup("devs", ""); !errors.Is(err, ErrGroupExists) {
+		t.Errorf("creating devs twice returned %v, want ErrGroupExists", err)
+	}
+	if _, err := um.AddPolicyRule("devs", "10.1.0.1/16", "TCP", "22,443", "ssh and https"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.AddPolicyRule("sites", "devs", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][4]string{
+		{"nobody", "10.1.0.0/16", "", ""},
+		{"devs", "nobody", "", ""},
+		{"devs", "10.1.0.0/16", "icmp", ""},
+		{"devs", "10.1.0.0/16", "tcp", "0-22"},
+	} {
+		if _, err := um.AddPolicyRule(args[0], args[1], args[2], args[3], ""); err == nil {
+			t.Errorf("AddPolicyRule%v succeeded", args)
+		}
+	}
+
+	tests := []struct {
+		from, to, proto string
+		port            int
+		allowed         bool
+	}{
+		{"alice", "10.1.2.3", "tcp", 22, true},
+		{"alice", "10.1.2.3", "tcp", 80, false},
+		{"alice", "10.1.2.3", "udp", 22, false},
+		{"alice", "10.1.2.3", "", 0, false},
+		{"alice", "bob", "", 0, false},
+		{"alice", "8.8.8.8", "", 0, true},
+		{"site-a", "alice", "udp", 53, true},
+		{"bob", "site-a", "tcp", 22, false},
+	}
+	for _, tt := range tests {
+		decision, err := um.EvaluatePolicy(testServerConfig, tt.from, tt.to, tt.proto, tt.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.Allowed != tt.allowed {
+			t.Errorf("%s to %s %s/%d: %+v, want allowed %t", tt.from, tt.to, tt.proto, tt.port, decision, tt.allowed)
+		}
+	}
+
+	rules, err := um.GeneratePolicy(testServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`add rule inet wg_mgr_wg0 forward iifname "wg0" ip saddr { 100.10.10.3/32 } ip daddr { 10.1.0.0/16 } tcp dport { 22, 443 } accept comment "rule 1"`,
+		`add rule inet wg_mgr_wg0 forward iifname "wg0" ip saddr { 100.10.10.2/32, 10.1.0.0/16 } ip daddr { 100.10.10.3/32 } accept comment "rule 2"`,
+		`add rule inet wg_mgr_wg0 forward iifname "wg0" ip daddr { 100.10.10.0/24, 10.1.0.0/16 } drop`,
+	} {
+		if !strings.Contains(rules, want+"\n") {
+			t.Errorf("ruleset is missing %s:\n%s", want, rules)
+		}
+	}
+
+	serverConf, err := um.GenerateServerConfig(testServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(serverConf, "PostUp = nft 'add table inet wg_mgr_wg0; flush table inet wg_mgr_wg0; ") ||
+		!strings.Contains(serverConf, "PostDown = nft delete table inet wg_mgr_wg0\n") {
+		t.Errorf("server config does not load the policy:\n%s", serverConf)
+	}
+
+	// 删除用户后不再出现在规则中
+	if err := um.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	rules, err = um.GeneratePolicy(testServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(rules, "100.10.10.3/32") {
+		t.Errorf("deleted user is still in the ruleset:\n%s", rules)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidRoute 路由不是合法的 CIDR
+var ErrInvalidRoute = errors.New("invalid route")
+
+// ErrRouteNotFound 当前接口上没有该路由
+var ErrRouteNotFound = errors.New("route not found")
+
+// RouteConflictError 广播的路由与已有前缀重叠
+type RouteConflictError struct {
+	Route    string // 新广播的路由
+	Conflict string // 与之重叠的前缀
+	Owner    string // 占用该前缀的用户，或 "ip pool"、"server address"
+}
+
+func (e *RouteConflictError) Error() string {
+	return fmt.Sprintf("advertise route %s overlaps %s owned by %s", e.Route, e.Conflict, e.Owner)
+}
+
+// ownedPrefix 已被占用的前缀及其所有者
+type ownedPrefix struct {
+	prefix netip.Prefix
+	owner  string
+}
+
+// parseRoute 解析路由并返回规范形式，如 10.10.0.1/16 返回 10.10.0.0/16
+func parseRoute(route string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(route)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%w %q: %v", ErrInvalidRoute, route, err)
+	}
+	return prefix.Masked(), nil
+}
+
+// newRoutes 将逗号分隔的前缀列表转换为待创建或待接受的路由
+func newRoutes(prefixes string) []Route {
+	var routes []Route
+	for _, prefix := range splitList(prefixes) {
+		routes = append(routes, Route{Prefix: prefix, Enabled: true})
+	}
+	return routes
+}
+
+// routePrefixes 返回路由的前缀，enabledOnly 时跳过禁用的路由
+func routePrefixes(routes []Route, enabledOnly bool) []string {
+	var prefixes []string
+	for _, route := range routes {
+		if enabledOnly && !route.Enabled {
+			continue
+		}
+		prefixes = append(prefixes, route.Prefix)
+	}
+	return prefixes
+}
+
+// routes 返回限定在当前接口、带有所有者的路由查询
+func (um *UserManager) routes() *gorm.DB {
+	return um.db.Model(&Route{}).
+		Select("routes.*, users.user_id AS owner").
+		Joins("JOIN users ON users.id = routes.owner_id").
+		Where("users.interface = ?", um.iface)
+}
+
+// checkNewRoutes 将 routes 规范化，并检查是否与已有路由、地址池或服务端地址重叠
+func (um *UserManager) checkNewRoutes(serverConfig ServerConfig, owner string, routes []Route) error {
+	if len(routes) == 0 {
+		return nil
+	}
+
+	var owned []ownedPrefix
+	for _, pool := range []string{serverConfig.IPPool, serverConfig.IPPoolV6} {
+		if prefix, err := netip.ParsePrefix(pool); err == nil {
+			owned = append(owned, ownedPrefix{prefix.Masked(), "ip pool"})
+		}
+	}
+	for _, address := range []string{serverConfig.IP, serverConfig.IPv6} {
+		if prefix, err := netip.ParsePrefix(address); err == nil {
+			owned = append(owned, ownedPrefix{prefix.Masked(), "server address"})
+		}
+	}
+
+	// 同一主机上的接口共用路由表，所以检查所有接口的路由，包括禁用的路由
+	var existing []Route
+	err := um.db.Model(&Route{}).
+		Select("routes.*, users.user_id AS owner").
+		Joins("JOIN users ON users.id = routes.owner_id").
+		Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	for _, route := range existing {
+		if prefix, err := parseRoute(route.Prefix); err == nil {
+			owned = append(owned, ownedPrefix{prefix, route.Owner})
+		}
+	}
+
+	for i := range routes {
+		prefix, err := parseRoute(routes[i].Prefix)
+		if err != nil {
+			return err
+		}
+		for _, o := range owned {
+			if prefix.Overlaps(o.prefix) {
+				return &RouteConflictError{Route: prefix.String(), Conflict: o.prefix.String(), Owner: o.owner}
+			}
+		}
+		owned = append(owned, ownedPrefix{prefix, owner})
+		routes[i].Prefix = prefix.String()
+	}
+	return nil
+}
+
+// resolveRoutes 按前缀查找当前接口上已有的路由，用于接受路由
+func (um *UserManager) resolveRoutes(routes []Route) ([]Route, error) {
+	resolved := make([]Route, 0, len(routes))
+	for _, route := range routes {
+		found, err := um.findRoute(route.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, *found)
+	}
+	return resolved, nil
+}
+
+func (um *UserManager) findRoute(prefix string) (*Route, error) {
+	p, err := parseRoute(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var route Route
+	err = um.routes().Where("routes.prefix = ?", p.String()).First(&route).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrRouteNotFound, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &route, nil
+}
+
+// SelectRoutes 将 CIDR 或路由所有者的用户 ID 解析为当前接口上启用的路由，
+// 用户 ID 表示接受该用户广播的全部路由
+func (um *UserManager) SelectRoutes(selectors []string) ([]Route, error) {
+	var selected []Route
+	seen := make(map[uint]bool)
+	add := func(routes ...Route) {
+		for _, route := range routes {
+			if !seen[route.ID] {
+				seen[route.ID] = true
+				selected = append(selected, route)
+			}
+		}
+	}
+	for _, selector := range selectors {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+		if strings.Contains(selector, "/") {
+			route, err := um.findRoute(selector)
+			if err != nil {
+				return nil, err
+			}
+			add(*route)
+			continue
+		}
+		var owned []Route
+		err := um.routes().Where("users.user_id = ? AND routes.enabled = ?", selector, true).Order("routes.prefix").Find(&owned).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(owned) == 0 {
+			return nil, fmt.Errorf("%w: %s is neither a CIDR nor a user advertising routes", ErrRouteNotFound, selector)
+		}
+		add(owned...)
+	}
+	return selected, nil
+}
+
+// AllRoutes 返回当前接口上所有启用的路由
+func (um *UserManager) AllRoutes() ([]Route, error) {
+	var routes []Route
+	err := um.routes().Where("routes.enabled = ?", true).Order("routes.prefix").Find(&routes).Error
+	return routes, err
+}
+
+// GetAllRoutes 返回当前接口上所有启用的路由前缀
+func (um *UserManager) GetAllRoutes() ([]string, error) {
+	var routes []string
+	err := um.db.Table("routes").
+		Joins("JOIN users ON users.id = routes.owner_id").
+		Where("users.interface = ? AND routes.enabled = ?", um.iface, true).
+		Order("routes.prefix").
+		Pluck("routes.prefix", &routes).Error
+	return routes, err
+}
+
+// ListRoutes 返回当前接口上的所有路由
+func (um *UserManager) ListRoutes() ([]Route, error) {
+	var routes []Route
+	err := um.routes().Order("users.user_id, routes.prefix").Find(&routes).Error
+	return routes, err
+}
+
+// AddRoute 为用户广播一个新路由
+func (um *UserManager) AddRoute(serverConfig ServerConfig, userID string, prefix string, description string) (*Route, error) {
+	route := Route{Prefix: prefix, Description: description, Enabled: true}
+	err := um.db.Transaction(func(tx *gorm.DB) error {
+		txum := um.withDB(tx)
+		user, err := txum.GetUser(userID)
+		if err != nil {
+			return err
+		}
+		routes := []Route{route}
+		if err := txum.checkNewRoutes(serverConfig, userID, routes); err != nil {
+			return err
+		}
+		route = routes[0]
+		route.OwnerID = user.ID
+		return tx.Create(&route).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	route.Owner = userID
+	return &route, um.applyUser(userID)
+}
+
+// RemoveRoute 删除路由，同时取消所有用户对它的接受
+func (um *UserManager) RemoveRoute(prefix string) error {
+	route, err := um.findRoute(prefix)
+	if err != nil {
+		return err
+	}
+	err = um.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM user_accepted_routes WHERE route_id = ?", route.ID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Route{}, route.ID).Error
+	})
+	if err != nil {
+		return err
+	}
+	return um.applyUser(route.Owner)
+}
+
+// SetRouteEnabled 启用或禁用路由
+func (um *UserManager) SetRouteEnabled(prefix string, enabled bool) error {
+	route, err := um.findRoute(prefix)
+	if err != nil {
+		return err
+	}
+	err = um.db.Model(&Route{}).Where("id = ?", route.ID).Update("enabled", enabled).Error
+	if err != nil {
+		return err
+	}
+	return um.applyUser(route.Owner)
+}
+
+// AcceptRoute 让用户接受当前接口上的一个路由
+func (um *UserManager) AcceptRoute(userID string, prefix string) error {
+	user, err := um.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	route, err := um.findRoute(prefix)
+	if err != nil {
+		return err
+	}
+	return um.db.Exec("INSERT OR IGNORE INTO user_accepted_routes (user_id, route_id) VALUES (?, ?)", user.ID, route.ID).Error
+}
+
+// UnacceptRoute 取消用户对路由的接受
+func (um *UserManager) UnacceptRoute(userID string, prefix string) error {
+	user, err := um.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	route, err := um.findRoute(prefix)
+	if err != nil {
+		return err
+	}
+	return um.db.Exec("DELETE FROM user_accepted_routes WHERE user_id = ? AND route_id = ?", user.ID, route.ID).Error
+}
+
+// SetAcceptAllRoutes 设置用户是否接受接口上当前和以后的所有路由
+func (um *UserManager) SetAcceptAllRoutes(userID string, acceptAll bool) error {
+	result := um.users().Where("user_id = ?", userID).Update("accept_all_routes", acceptAll)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// subscribedRoutes 返回订阅全部路由的用户应接受的路由，不包括用户自己广播的路由
+func subscribedRoutes(user User, routes []Route) []Route {
+	var subscribed []Route
+	for _, route := range routes {
+		if route.OwnerID != user.ID {
+			subscribed = append(subscribed, route)
+		}
+	}
+	return subscribed
+}
+
+// StaleConfig 是路由变更后 AllowedIPs 与已下发的配置不一致的用户
+type StaleConfig struct {
+	UserID  string `json:"user_id"`
+	Issued  string `json:"issued"`  // 已下发配置中的 AllowedIPs，为空表示没有记录
+	Current string `json:"current"` // 按当前路由生成的 AllowedIPs
+}
+
+// StaleConfigs 返回当前接口上需要重新下发客户端配置的用户
+func (um *UserManager) StaleConfigs() ([]StaleConfig, error) {
+	users, err := um.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+	routes, err := um.AllRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []StaleConfig
+	for _, user := range users {
+		if user.AcceptAllRoutes {
+			user.AcceptedRoutes = subscribedRoutes(user, routes)
+		}
+		current := clientAllowedIPs(user)
+		if current != user.IssuedAllowedIPs {
+			stale = append(stale, StaleConfig{UserID: user.UserID, Issued: user.IssuedAllowedIPs, Current: current})
+		}
+	}
+	return stale, nil
+}
+
+// applyUser 将用户当前的 Peer 配置同步到接口
+func (um *UserManager) applyUser(userID string) error {
+	if um.device == "" {
+		return nil
+	}
+	user, err := um.GetUser(userID)
+	if err != nil {
+		return &ApplyError{Device: um.device, Err: err}
+	}
+	opened, err := um.OpenUser(*user)
+	if err != nil {
+		return &ApplyError{Device: um.device, Err: err}
+	}
+	peer, err := peerConfig(opened)
+	if err != nil {
+		return &ApplyError{Device: um.device, Err: err}
+	}
+	return um.applyPeers(peer)
+}
+
+// migrateLegacyRoutes 将旧版本 users 表中逗号分隔的 advertise_routes、accept_routes
+// 迁移到 routes 表，然后删除这两列
+func (um *UserManager) migrateLegacyRoutes() error {
+	migrator := um.db.Migrator()
+	if !migrator.HasColumn(&User{}, "advertise_routes") {
+		return nil
+	}
+
+	type legacyUser struct {
+		ID              uint
+		UserID          string
+		AdvertiseRoutes string
+		AcceptRoutes    string
+	}
+	var legacy []legacyUser
+	err := um.db.Raw("SELECT id, user_id, advertise_routes, accept_routes FROM users").Scan(&legacy).Error
+	if err != nil {
+		return err
+	}
+
+	return um.db.Transaction(func(tx *gorm.DB) error {
+		routeIDs := make(map[string]uint)
+		for _, user := range legacy {
+			for _, prefix := range splitList(user.AdvertiseRoutes) {
+				p, err := parseRoute(prefix)
+				if err != nil {
+					log.Printf("dropping advertise route of %s: %v", user.UserID, err)
+					continue
+				}
+				if _, ok := routeIDs[p.String()]; ok {
+					log.Printf("dropping duplicate advertise route %s of %s", p, user.UserID)
+					continue
+				}
+				route := Route{Prefix: p.String(), OwnerID: user.ID, Enabled: true}
+				if err := tx.Create(&route).Error; err != nil {
+					return err
+				}
+				routeIDs[route.Prefix] = route.ID
+			}
+		}
+		for _, user := range legacy {
+			for _, prefix := range splitList(user.AcceptRoutes) {
+				p, err := parseRoute(prefix)
+				if err != nil {
+					log.Printf("dropping accepted route of %s: %v", user.UserID, err)
+					continue
+				}
+				routeID, ok := routeIDs[p.String()]
+				if !ok {
+					log.Printf("dropping accepted route %s of %s: no peer advertises it", p, user.UserID)
+					continue
+				}
+				err = tx.Exec("INSERT OR IGNORE INTO user_accepted_routes (user_id, route_id) VALUES (?, ?)", user.ID, routeID).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := tx.Exec("ALTER TABLE users DROP COLUMN advertise_routes").Error; err != nil {
+			return err
+		}
+		return tx.Exec("ALTER TABLE users DROP COLUMN accept_routes").Error
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdvertiseRouteConflicts(t *testing.T) {
+	um := newTestUserManager(t)
+
+	site := &User{UserID: "site-a", AdvertisedRoutes: newRoutes("10.10.0.1/16")}
+	if err := um.AddUser(testServerConfig, site); err != nil {
+		t.Fatal(err)
+	}
+	if site.AdvertisedRoutes[0].Prefix != "10.10.0.0/16" {
+		t.Errorf("stored route %s, want 10.10.0.0/16", site.AdvertisedRoutes[0].Prefix)
+	}
+
+	tests := []struct {
+		routes string
+		owner  string
+	}{
+		{"10.10.10.0/24", "site-a"},
+		{"10.0.0.0/8", "site-a"},
+		{"100.10.10.128/25", "ip pool"},
+		{"192.168.1.0/24, 192.168.0.0/16", "site-b"},
+	}
+	for _, tt := range tests {
+		err := um.AddUser(testServerConfig, &User{UserID: "site-b", AdvertisedRoutes: newRoutes(tt.routes)})
+		var conflict *RouteConflictError
+		if !errors.As(err, &conflict) || conflict.Owner != tt.owner {
+			t.Errorf("routes %s: got %v, want conflict owned by %s", tt.routes, err, tt.owner)
+		}
+	}
+
+	serverConfig := testServerConfig
+	serverConfig.IP = "172.16.0.1/24"
+	err := um.AddUser(serverConfig, &User{UserID: "site-b", AdvertisedRoutes: newRoutes("172.16.0.0/16")})
+	var conflict *RouteConflictError
+	if !errors.As(err, &conflict) || conflict.Owner != "server address" {
+		t.Errorf("got %v, want conflict with the server address", err)
+	}
+
+	if err := um.AddUser(testServerConfig, &User{UserID: "site-b", AdvertisedRoutes: newRoutes("10.11.0.0/16")}); err != nil {
+		t.Errorf("non-overlapping route rejected: %v", err)
+	}
+	if err := um.AddUser(testServerConfig, &User{UserID: "site-c", AdvertisedRoutes: newRoutes("10.12.0.0")}); !errors.Is(err, ErrInvalidRoute) {
+		t.Errorf("got %v, want ErrInvalidRoute", err)
+	}
+}
+
+func TestRoutesInConfigs(t *testing.T) {
+	um := newTestUserManager(t)
+
+	if err := um.AddUser(testServerConfig, &User{UserID: "site-a", AdvertisedRoutes: newRoutes("10.1.0.0/16,10.2.0.0/16")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.AddRoute(testServerConfig, "site-a", "10.3.0.0/16", "lab"); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.AddUser(testServerConfig, &User{UserID: "laptop", AcceptedRoutes: newRoutes("10.1.0.0/16")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.AcceptRoute("laptop", "10.3.0.1/16"); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.AcceptRoute("laptop", "10.9.0.0/16"); !errors.Is(err, ErrRouteNotFound) {
+		t.Errorf("accepting an unknown route returned %v, want ErrRouteNotFound", err)
+	}
+	if err := um.SetRouteEnabled("10.2.0.0/16", false); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConf, err := um.GenerateServerConfig(testServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(serverConf, "AllowedIPs = 100.10.10.2/32, 10.1.0.0/16, 10.3.0.0/16 \n") {
+		t.Errorf("server config does not join site-a routes:\n%s", serverConf)
+	}
+	config, err := um.UserConfig(testServerConfig, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "AllowedIPs = 100.10.10.3/24, 10.1.0.0/16, 10.3.0.0/16\n") {
+		t.Errorf("client config does not include accepted routes:\n%s", config)
+	}
+
+	routes, err := um.GetAllRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(routes, " ") != "10.1.0.0/16 10.3.0.0/16" {
+		t.Errorf("enabled routes = %v", routes)
+	}
+
+	if err := um.DeleteUser("site-a"); err != nil {
+		t.Fatal(err)
+	}
+	laptop, err := um.GetUser("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(laptop.AcceptedRoutes) != 0 {
+		t.Errorf("laptop still accepts %v after site-a was deleted", laptop.AcceptedRoutes)
+	}
+}
+
+func TestMigrateLegacyRoutes(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "users.db")
+	um := openTestUserManager(t, dbPath)
+	for _, id := range []string{"site-a", "laptop"} {
+		if err := um.AddUser(testServerConfig, &User{UserID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 还原为旧版本的表结构
+	for _, stmt := range []string{
+		"ALTER TABLE users ADD COLUMN advertise_routes text",
+		"ALTER TABLE users ADD COLUMN accept_routes text",
+		"UPDATE users SET advertise_routes = '10.1.0.0/16,10.2.0.0/16', accept_routes = '' WHERE user_id = 'site-a'",
+		"UPDATE users SET advertise_routes = '', accept_routes = '10.1.0.0/16,10.2.0.0/16,10.9.0.0/16' WHERE user_id = 'laptop'",
+	} {
+		if err := um.db.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	um = openTestUserManager(t, dbPath)
+	if um.db.Migrator().HasColumn(&User{}, "advertise_routes") {
+		t.Error("legacy advertise_routes column was not dropped")
+	}
+	site, err := um.GetUser("site-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(routePrefixes(site.AdvertisedRoutes, false), ","); got != "10.1.0.0/16,10.2.0.0/16" {
+		t.Errorf("site-a advertises %s", got)
+	}
+	laptop, err := um.GetUser("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(routePrefixes(laptop.AcceptedRoutes, false), ","); got != "10.1.0.0/16,10.2.0.0/16" {
+		t.Errorf("laptop accepts %s", got)
+	}
+}
+
+func TestSelectRoutes(t *testing.T) {
+	um := newTestUserManager(t)
+	if err := um.AddUser(testServerConfig, &User{UserID: "site-a", AdvertisedRoutes: newRoutes("10.1.0.0/16,10.2.0.0/16")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.AddUser(testServerConfig, &User{UserID: "site-b", AdvertisedRoutes: newRoutes("10.3.0.0/16")}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		selectors []string
+		want      string
+	}{
+		{[]string{"site-a"}, "10.1.0.0/16,10.2.0.0/16"},
+		{[]string{"10.3.0.0/16", "site-a", "10.1.0.0/16"}, "10.3.0.0/16,10.1.0.0/16,10.2.0.0/16"},
+	}
+	for _, tt := range tests {
+		routes, err := um.SelectRoutes(tt.selectors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(routePrefixes(routes, false), ","); got != tt.want {
+			t.Errorf("SelectRoutes(%v) = %s, want %s", tt.selectors, got, tt.want)
+		}
+	}
+	for _, selector := range []string{"nobody", "10.9.0.0/16"} {
+		if _, err := um.SelectRoutes([]string{selector}); !errors.Is(err, ErrRouteNotFound) {
+			t.Errorf("SelectRoutes(%s) returned %v, want ErrRouteNotFound", selector, err)
+		}
+	}
+}
+
+func TestAcceptAllRoutes(t *testing.T) {
+	um := newTestUserManager(t)
+
+	if err := um.AddUser(testServerConfig, &User{UserID: "site-a", AdvertisedRoutes: newRoutes("10.1.0.0/16"), AcceptAllRoutes: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.AddUser(testServerConfig, &User{UserID: "laptop", AcceptAllRoutes: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.IssueUserConfig(testServerConfig, "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := um.StaleConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || stale[0].UserID != "site-a" || stale[0].Issued != "" {
+		t.Errorf("stale configs = %+v, want only site-a without an issued config", stale)
+	}
+
+	// 新广播的路由下发给订阅了全部路由的用户，但不包括广播者自己
+	if _, err := um.AddRoute(testServerConfig, "site-a", "10.2.0.0/16", ""); err != nil {
+		t.Fatal(err)
+	}
+	stale, err = um.StaleConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 2 || stale[1].UserID != "laptop" || stale[1].Current != "100.10.10.3/24, 10.1.0.0/16, 10.2.0.0/16" {
+		t.Errorf("stale configs = %+v, want laptop with the new route", stale)
+	}
+	config, err := um.UserConfig(testServerConfig, "site-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "AllowedIPs = 100.10.10.2/24\n") {
+		t.Errorf("site-a accepts its own routes:\n%s", config)
+	}
+	// 查看配置不算下发
+	if stale, err := um.StaleConfigs(); err != nil || len(stale) != 2 {
+		t.Errorf("stale configs after viewing = %+v, %v, want site-a and laptop", stale, err)
+	}
+	for _, id := range []string{"site-a", "laptop"} {
+		if _, err := um.IssueUserConfig(testServerConfig, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stale, err := um.StaleConfigs(); err != nil || len(stale) != 0 {
+		t.Errorf("stale configs after redistribution = %+v, %v", stale, err)
+	}
+
+	if err := um.SetAcceptAllRoutes("laptop", false); err != nil {
+		t.Fatal(err)
+	}
+	stale, err = um.StaleConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || stale[0].Current != "100.10.10.3/24" {
+		t.Errorf("stale configs after unsubscribing = %+v", stale)
+	}
+	if err := um.SetAcceptAllRoutes("nobody", true); err == nil {
+		t.Error("subscribed an unknown user")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// sealedPrefix 标记已加密的字段
+	sealedPrefix = "enc:v1:"
+
+	masterKeyEnv     = "WG_MGR_MASTER_KEY"
+	masterKeyFileEnv = "WG_MGR_MASTER_KEY_FILE"
+)
+
+var errNoMasterKey = errors.New("value is encrypted but no master key is configured, set " + masterKeyEnv + " or " + masterKeyFileEnv)
+
+// KeySealer 使用 NaCl secretbox 加密私钥等敏感字段。
+// nil 表示未配置主密钥，此时 Seal 原样返回明文。
+type KeySealer struct {
+	key [32]byte
+}
+
+// LoadMasterKey 从环境变量读取主密钥（base64 编码的 32 字节），未配置时返回 nil
+func LoadMasterKey() (*KeySealer, error) {
+	encoded := os.Getenv(masterKeyEnv)
+	if path := os.Getenv(masterKeyFileEnv); encoded == "" && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key file: %w", err)
+		}
+		encoded = string(data)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %w", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("invalid master key: want 32 bytes, got %d", len(raw))
+	}
+	s := &KeySealer{}
+	copy(s.key[:], raw)
+	return s, nil
+}
+
+// isSealed 判断字段是否已加密
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// Seal 加密明文，空值和已加密的值原样返回
+func (s *KeySealer) Seal(plaintext string) (string, error) {
+	if s == nil || plaintext == "" || isSealed(plaintext) {
+		return plaintext, nil
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	box := secretbox.Seal(nonce[:], []byte(plaintext), &nonce, &s.key)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(box), nil
+}
+
+// Open 解密字段，未加密的值原样返回
+func (s *KeySealer) Open(value string) (string, error) {
+	if !isSealed(value) {
+		return value, nil
+	}
+	if s == nil {
+		return "", errNoMasterKey
+	}
+	box, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %w", err)
+	}
+	if len(box) < 24 {
+		return "", errors.New("malformed encrypted value")
+	}
+	var nonce [24]byte
+	copy(nonce[:], box[:24])
+	plaintext, ok := secretbox.Open(nil, box[24:], &nonce, &s.key)
+	if !ok {
+		return "", errors.New("failed to decrypt value, wrong master key?")
+	}
+	return string(plaintext), nil
+}
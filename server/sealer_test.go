@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeySealer(t *testing.T) {
+	sealer := &KeySealer{key: [32]byte{1, 2, 3}}
+
+	sealed, err := sealer.Seal("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed) {
+		t.Fatalf("sealed value %q has no prefix", sealed)
+	}
+	opened, err := sealer.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != "secret" {
+		t.Errorf("opened %q, want secret", opened)
+	}
+
+	var none *KeySealer
+	if _, err := none.Open(sealed); err == nil {
+		t.Error("expected opening without master key to fail")
+	}
+	if _, err := (&KeySealer{key: [32]byte{9}}).Open(sealed); err == nil {
+		t.Error("expected opening with the wrong master key to fail")
+	}
+}
+
+func TestAddUserSealsPrivateKey(t *testing.T) {
+	um := newTestUserManager(t)
+	um.SetSealer(&KeySealer{key: [32]byte{1}})
+
+	if err := um.AddUser(testServerConfig, &User{UserID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := um.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(stored.PrivateKey) {
+		t.Errorf("private key stored in plaintext: %q", stored.PrivateKey)
+	}
+
+	config, err := um.UserConfig(ServerConfig{}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "PrivateKey = private-1") {
+		t.Errorf("config does not contain the opened private key:\n%s", config)
+	}
+}
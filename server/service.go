@@ -4,26 +4,43 @@ import (
 	"errors"
 	"fmt"
 	"golang.zx2c4.com/wireguard/wgctrl"
-	"log"
-	"net"
-	"os/exec"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"strings"
+	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type UserManager struct {
-	db *gorm.DB
+	db     *gorm.DB
+	keys   KeyGenerator
+	sealer *KeySealer // 为 nil 时私钥以明文保存
+	iface  string     // 用户相关的操作只作用于该接口
+	group  string     // 非空时，用户相关的操作只作用于该分组的成员
+	device string     // 非空时，用户变更会同步到该 WireGuard 接口
 }
 
+// sqliteOptions 写事务以 BEGIN IMMEDIATE 开始，并发写入时等待锁而不是立即失败
+const sqliteOptions = "_busy_timeout=5000&_txlock=immediate"
+
 func NewUserManager(dbPath string) (*UserManager, error) {
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	dsn := dbPath + "?" + sqliteOptions
+	if strings.Contains(dbPath, "?") {
+		dsn = dbPath + "&" + sqliteOptions
+	}
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
 
-	um := &UserManager{db: db}
+	sealer, err := LoadMasterKey()
+	if err != nil {
+		return nil, err
+	}
+
+	um := &UserManager{db: db, keys: wgKeyGenerator{}, sealer: sealer, iface: defaultInterface}
 	err = um.createTable()
 	if err != nil {
 		return nil, err
@@ -33,97 +50,592 @@ func NewUserManager(dbPath string) (*UserManager, error) {
 }
 
 func (um *UserManager) createTable() error {
-	return um.db.AutoMigrate(&User{})
+	err := um.db.AutoMigrate(&User{}, &Route{}, &APIToken{}, &Interface{}, &ReleasedIP{}, &Group{}, &PolicyRule{})
+	if err != nil {
+		return err
+	}
+	if err := um.migrateUserIDIndex(); err != nil {
+		return err
+	}
+	return um.migrateLegacyRoutes()
+}
+
+// migrateUserIDIndex 删除旧版本 user_id 上的全局唯一索引，用户 ID 只需在接口内唯一。
+// 地址和路由仍然全局唯一：同一主机上的接口共用路由表
+func (um *UserManager) migrateUserIDIndex() error {
+	migrator := um.db.Migrator()
+	if !migrator.HasIndex(&User{}, "idx_users_user_id") {
+		return nil
+	}
+	return migrator.DropIndex(&User{}, "idx_users_user_id")
+}
+
+// ForInterface 返回共享同一数据库、只操作 name 接口下用户的 UserManager
+func (um *UserManager) ForInterface(name string) *UserManager {
+	scoped := *um
+	scoped.iface = name
+	return &scoped
+}
+
+// Interface 返回当前操作的接口名
+func (um *UserManager) Interface() string {
+	return um.iface
+}
+
+// users 返回限定在当前接口（和分组）的用户查询
+func (um *UserManager) users() *gorm.DB {
+	query := um.db.Model(&User{}).Where("interface = ?", um.iface)
+	if um.group != "" {
+		query = query.Where("id IN (SELECT group_members.user_id FROM group_members JOIN groups ON groups.id = group_members.group_id WHERE groups.name = ?)", um.group)
+	}
+	return query
+}
+
+// loadUsers 与 users 相同，同时加载用户广播和接受的路由以及所在的分组
+func (um *UserManager) loadUsers() *gorm.DB {
+	return um.users().Preload("AdvertisedRoutes").Preload("AcceptedRoutes").Preload("Groups", func(db *gorm.DB) *gorm.DB {
+		return db.Order("name")
+	})
+}
+
+// SetKeyGenerator 替换密钥生成器
+func (um *UserManager) SetKeyGenerator(keys KeyGenerator) {
+	um.keys = keys
+}
+
+// SetSealer 设置加密私钥使用的主密钥，传 nil 则以明文保存
+func (um *UserManager) SetSealer(sealer *KeySealer) {
+	um.sealer = sealer
+}
+
+// sealUser 加密用户的私钥和预共享密钥
+func (um *UserManager) sealUser(user *User) error {
+	var err error
+	if user.PrivateKey, err = um.sealer.Seal(user.PrivateKey); err != nil {
+		return err
+	}
+	user.PresharedKey, err = um.sealer.Seal(user.PresharedKey)
+	return err
+}
+
+// sealValues 加密待更新字段中的私钥和预共享密钥
+func (um *UserManager) sealValues(values interface{}) (interface{}, error) {
+	switch v := values.(type) {
+	case User:
+		err := um.sealUser(&v)
+		return v, err
+	case map[string]interface{}:
+		sealed := make(map[string]interface{}, len(v))
+		for column, value := range v {
+			if s, ok := value.(string); ok && (column == "private_key" || column == "preshared_key") {
+				var err error
+				if value, err = um.sealer.Seal(s); err != nil {
+					return nil, err
+				}
+			}
+			sealed[column] = value
+		}
+		return sealed, nil
+	}
+	return values, nil
+}
+
+// OpenUser 返回解密私钥和预共享密钥后的用户，仅在生成配置时使用
+func (um *UserManager) OpenUser(user User) (User, error) {
+	var err error
+	if user.PrivateKey, err = um.sealer.Open(user.PrivateKey); err != nil {
+		return user, fmt.Errorf("failed to open private key of user %s: %w", user.UserID, err)
+	}
+	if user.PresharedKey, err = um.sealer.Open(user.PresharedKey); err != nil {
+		return user, fmt.Errorf("failed to open preshared key of user %s: %w", user.UserID, err)
+	}
+	return user, nil
+}
+
+// openUsers 批量解密用户
+func (um *UserManager) openUsers(users []User) ([]User, error) {
+	opened := make([]User, 0, len(users))
+	for _, user := range users {
+		user, err := um.OpenUser(user)
+		if err != nil {
+			return nil, err
+		}
+		opened = append(opened, user)
+	}
+	return opened, nil
 }
 
-func (um *UserManager) AddUser(user *User) error {
-	serverConfig, err := LoadServerConfig("server.yaml")
+// MigrateEncrypt 将数据库和服务端配置中的明文私钥加密保存，返回加密的用户数。
+// 该操作作用于所有接口
+func (um *UserManager) MigrateEncrypt(configPath string) (int, error) {
+	if um.sealer == nil {
+		return 0, errors.New("no master key configured, set " + masterKeyEnv + " or " + masterKeyFileEnv)
+	}
+
+	count := 0
+	err := um.db.Transaction(func(tx *gorm.DB) error {
+		var users []User
+		if err := tx.Find(&users).Error; err != nil {
+			return err
+		}
+		for _, user := range users {
+			if (user.PrivateKey == "" || isSealed(user.PrivateKey)) && (user.PresharedKey == "" || isSealed(user.PresharedKey)) {
+				continue
+			}
+			if err := um.sealUser(&user); err != nil {
+				return err
+			}
+			err := tx.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+				"private_key":   user.PrivateKey,
+				"preshared_key": user.PresharedKey,
+			}).Error
+			if err != nil {
+				return err
+			}
+			count++
+		}
+
+		var ifaces []Interface
+		if err := tx.Find(&ifaces).Error; err != nil {
+			return err
+		}
+		for _, iface := range ifaces {
+			if isSealed(iface.PrivateKey) {
+				continue
+			}
+			sealed, err := um.sealer.Seal(iface.PrivateKey)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&iface).Update("private_key", sealed).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	ipPoolCIDR := serverConfig.IPPool
 
-	ipPool, err := generateIPPool(ipPoolCIDR)
+	serverConfig, err := LoadServerConfig(configPath)
 	if err != nil {
-		return err
+		return count, err
+	}
+	if serverConfig.PrivateKey != "" && !isSealed(serverConfig.PrivateKey) {
+		sealed, err := um.sealer.Seal(serverConfig.PrivateKey)
+		if err != nil {
+			return count, err
+		}
+		err = UpdateServerConfigValues(configPath, map[string]string{"private_key": sealed})
+		if err != nil {
+			return count, err
+		}
 	}
+	return count, nil
+}
 
-	var usedIPs []string
-	err = um.db.Model(&User{}).Pluck("ip", &usedIPs).Error
+// NewPresharedKey 生成一个新的预共享密钥
+func (um *UserManager) NewPresharedKey() (string, error) {
+	return um.keys.GeneratePresharedKey()
+}
+
+// RotatePresharedKey 为用户更换预共享密钥
+func (um *UserManager) RotatePresharedKey(userID string) error {
+	psk, err := um.NewPresharedKey()
 	if err != nil {
 		return err
 	}
+	return um.UpdateUser(User{UserID: userID, PresharedKey: psk})
+}
 
-	var newIP string
-	for _, ip := range ipPool {
-		used := false
-		for _, usedIP := range usedIPs {
-			if ip == usedIP {
-				used = true
-				break
-			}
+// RotateUserKey 为用户更换密钥，IP、路由和钩子保持不变。
+// publicKey 非空时使用客户端提供的公钥，服务端不再保存私钥
+func (um *UserManager) RotateUserKey(userID string, publicKey string) error {
+	var privateKey string
+	if publicKey != "" {
+		if err := validatePublicKey(publicKey); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		privateKey, publicKey, err = um.keys.GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+	}
+	return um.updateUser(userID, map[string]interface{}{
+		"private_key": privateKey,
+		"public_key":  publicKey,
+	})
+}
+
+// RotateServerKey 为当前接口生成新密钥对，server.yaml 描述的接口写回配置文件，
+// 其余接口写回数据库，返回需要重新分发配置的用户
+func (um *UserManager) RotateServerKey(configPath string) ([]User, error) {
+	privateKey, publicKey, err := um.keys.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	sealedKey, err := um.sealer.Seal(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	updated := configPath
+	fileConfig, err := LoadServerConfig(configPath)
+	if err == nil && fileConfig.InterfaceName() == um.iface {
+		err = UpdateServerConfigValues(configPath, map[string]string{
+			"private_key": sealedKey,
+			"public_key":  publicKey,
+		})
+	} else {
+		updated = "interfaces table in users.db"
+		var iface *Interface
+		iface, err = um.GetInterface(um.iface)
+		if err == nil {
+			err = um.db.Model(iface).Updates(map[string]interface{}{
+				"private_key": sealedKey,
+				"public_key":  publicKey,
+			}).Error
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := um.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+	if um.device != "" {
+		if err := configureDeviceKey(um.device, privateKey); err != nil {
+			return users, &ApplyError{Device: um.device, Updated: updated, Err: err}
+		}
+	}
+	return users, nil
+}
+
+// WithDevice 返回共享同一数据库的 UserManager，其用户变更会同步到 device，
+// 传空字符串则只修改数据库
+func (um *UserManager) WithDevice(device string) *UserManager {
+	scoped := *um
+	scoped.device = device
+	return &scoped
+}
+
+// applyPeers 将 Peer 变更下发到 um.device
+func (um *UserManager) applyPeers(peers ...wgtypes.PeerConfig) error {
+	if um.device == "" {
+		return nil
+	}
+	if err := configurePeers(um.device, peers); err != nil {
+		return &ApplyError{Device: um.device, Err: err}
+	}
+	return nil
+}
+
+// CheckDevice 比较数据库与接口的实际状态
+func (um *UserManager) CheckDevice(device string) (*DeviceDiff, error) {
+	client, err := newWGClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	dev, err := client.Device(device)
+	if err != nil {
+		return nil, err
+	}
+	users, err := um.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+	users, err = um.openUsers(users)
+	if err != nil {
+		return nil, err
+	}
+	return diffDevice(dev, activeUsers(users, time.Now())), nil
+}
+
+// addUserAttempts 自动分配的地址被并发请求占用时的最大尝试次数
+const addUserAttempts = 5
+
+// ErrUserExists 用户 ID 已存在
+var ErrUserExists = errors.New("user already exists")
+
+// errAddressTaken 自动分配的地址在写入前被其他请求占用
+var errAddressTaken = errors.New("allocated address was taken concurrently")
+
+func (um *UserManager) AddUser(serverConfig ServerConfig, user *User) error {
+	if user.PublicKey != "" {
+		// 客户端自带公钥，服务端不生成也不保存私钥
+		if err := validatePublicKey(user.PublicKey); err != nil {
+			return err
 		}
-		if !used {
-			newIP = ip
+		user.PrivateKey = ""
+	} else {
+		privateKey, publicKey, err := um.keys.GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+		user.PrivateKey = privateKey
+		user.PublicKey = publicKey
+	}
+	user.Interface = um.iface
+
+	// 地址分配、路由检查和写入在同一个事务中完成，地址被并发请求抢先写入时重新分配
+	ip, ipv6, allowedIPs := user.IP, user.IPv6, user.AllowedIPs
+	var err error
+	for attempt := 1; attempt <= addUserAttempts; attempt++ {
+		user.IP, user.IPv6, user.AllowedIPs = ip, ipv6, allowedIPs
+		err = um.db.Transaction(func(tx *gorm.DB) error {
+			return um.withDB(tx).createUser(serverConfig, user)
+		})
+		if err == nil || !retryableAddUserError(err) {
 			break
 		}
 	}
-	if newIP == "" {
-		return errors.New("no available IP addresses")
+	if err != nil {
+		return err
 	}
 
-	privateKey, publicKey, err := generateKeys()
+	if um.device == "" {
+		return nil
+	}
+	peer, err := peerConfig(*user)
 	if err != nil {
+		return &ApplyError{Device: um.device, Err: err}
+	}
+	return um.applyPeers(peer)
+}
+
+// withDB 返回使用 db（通常是事务）的 UserManager
+func (um *UserManager) withDB(db *gorm.DB) *UserManager {
+	scoped := *um
+	scoped.db = db
+	return &scoped
+}
+
+// createUser 分配地址、检查路由并写入用户，应在事务中调用
+func (um *UserManager) createUser(serverConfig ServerConfig, user *User) error {
+	// user.IP、user.IPv6 非空时为静态指定的地址
+	staticIP, staticIPv6 := user.IP != "", user.IPv6 != ""
+	if err := um.allocateIPs(serverConfig, user); err != nil {
 		return err
 	}
-	user.PrivateKey = privateKey
-	user.PublicKey = publicKey
 	if user.AllowedIPs == "" {
-		user.AllowedIPs = newIP + "/24"
+		user.AllowedIPs = user.IP + "/24"
+		if user.IPv6 != "" {
+			user.AllowedIPs += ", " + serverConfig.IPPoolV6
+		}
 	}
 
-	if user.AdvertiseRoutes != "" {
-		routes, _ := um.GetAllRoutes()
-		for _, v := range routes {
-			if v == user.AdvertiseRoutes {
-				return errors.New("advertise route already exists")
-			}
+	if err := um.checkNewRoutes(serverConfig, user.UserID, user.AdvertisedRoutes); err != nil {
+		return err
+	}
+	accepted, err := um.resolveRoutes(user.AcceptedRoutes)
+	if err != nil {
+		return err
+	}
+	user.AcceptedRoutes = accepted
+
+	// 入库的副本加密，调用方持有的 user 保持明文
+	sealed := *user
+	if err := um.sealUser(&sealed); err != nil {
+		return err
+	}
+	err = um.db.Create(&sealed).Error
+	switch {
+	case uniqueViolation(err, "users.interface, users.user_id"):
+		return fmt.Errorf("%w: %s", ErrUserExists, user.UserID)
+	case uniqueViolation(err, "users.ip"):
+		return addressConflict(user.IP, staticIP)
+	case uniqueViolation(err, "users.ipv6"):
+		return addressConflict(user.IPv6, staticIPv6)
+	case err != nil:
+		return err
+	}
+	user.ID = sealed.ID
+	return nil
+}
+
+// addressConflict 静态指定的地址被占用时返回 ErrAddressUnavailable，自动分配的地址可以重新分配
+func addressConflict(ip string, static bool) error {
+	if static {
+		return fmt.Errorf("%w: %s is already assigned", ErrAddressUnavailable, ip)
+	}
+	return fmt.Errorf("%w: %s", errAddressTaken, ip)
+}
+
+// retryableAddUserError 自动分配的地址冲突或数据库繁忙时可以重试
+func retryableAddUserError(err error) bool {
+	if errors.Is(err, errAddressTaken) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
+}
+
+// uniqueViolation 判断是否违反了 column（表名.列名）上的唯一约束
+func uniqueViolation(err error, column string) bool {
+	return err != nil && strings.HasSuffix(err.Error(), "UNIQUE constraint failed: "+column)
+}
+
+func (um *UserManager) GetUser(userID string) (*User, error) {
+	var user User
+	err := um.loadUsers().Where("user_id = ?", userID).First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UserConfig 生成用户的客户端配置，私钥在此处解密
+func (um *UserManager) UserConfig(serverConfig ServerConfig, userID string) (string, error) {
+	user, err := um.GetUser(userID)
+	if err != nil {
+		return "", err
+	}
+	config, _, err := um.renderUserConfig(serverConfig, *user)
+	return config, err
+}
+
+// IssueUserConfig 生成要下发给用户的客户端配置，并记录其中的 AllowedIPs，用于判断配置是否过期
+func (um *UserManager) IssueUserConfig(serverConfig ServerConfig, userID string) (string, error) {
+	user, err := um.GetUser(userID)
+	if err != nil {
+		return "", err
+	}
+	config, allowedIPs, err := um.renderUserConfig(serverConfig, *user)
+	if err != nil {
+		return "", err
+	}
+	if allowedIPs != user.IssuedAllowedIPs {
+		err := um.users().Where("user_id = ?", userID).UpdateColumn("issued_allowed_ips", allowedIPs).Error
+		if err != nil {
+			return "", err
 		}
 	}
+	return config, nil
+}
 
-	user.IP = newIP
-	err = um.db.Create(user).Error
-	return err
+// renderUserConfig 生成用户的客户端配置，同时返回其中的 AllowedIPs，不记录下发
+func (um *UserManager) renderUserConfig(serverConfig ServerConfig, user User) (string, string, error) {
+	opened, err := um.OpenUser(user)
+	if err != nil {
+		return "", "", err
+	}
+	if opened.AcceptAllRoutes {
+		routes, err := um.AllRoutes()
+		if err != nil {
+			return "", "", err
+		}
+		opened.AcceptedRoutes = subscribedRoutes(opened, routes)
+	}
+	return generateUserConfig(serverConfig, opened), clientAllowedIPs(opened), nil
 }
 
+// GetAllUsers 按添加顺序返回用户，生成的服务端配置中 Peer 顺序保持稳定
 func (um *UserManager) GetAllUsers() ([]User, error) {
 	var users []User
-	err := um.db.Find(&users).Error
+	err := um.loadUsers().Order("id").Find(&users).Error
 	return users, err
 }
 
-func (um *UserManager) GetAllRoutes() ([]string, error) {
-	var routes []string
-	err := um.db.Model(&User{}).Where("advertise_routes != ''").Pluck("advertise_routes", &routes).Error
-	return routes, err
+// GetUserViews 返回不含密钥的用户列表，接口不可用时在线状态均为离线
+func (um *UserManager) GetUserViews() ([]UserView, error) {
+	users, err := um.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+	handshakes := peerHandshakes()
+
+	views := make([]UserView, 0, len(users))
+	for _, user := range users {
+		views = append(views, newUserView(user, handshakes[user.PublicKey]))
+	}
+	return views, nil
+}
+
+// GetUserView 返回单个用户不含密钥的信息
+func (um *UserManager) GetUserView(userID string) (*UserView, error) {
+	user, err := um.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	view := newUserView(*user, peerHandshakes()[user.PublicKey])
+	return &view, nil
+}
+
+// SetUserDisabled 禁用或重新启用用户。禁用的用户保留地址、密钥、钩子和路由，
+// 只是不再出现在服务端配置和接口上
+func (um *UserManager) SetUserDisabled(userID string, disabled bool) error {
+	result := um.users().Where("user_id = ?", userID).Update("disabled", disabled)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return um.applyUser(userID)
 }
 
 func (um *UserManager) UpdateUser(user User) error {
-	err := um.db.Model(&User{}).Where("user_id = ?", user.UserID).Updates(user).Error
-	return err
+	return um.updateUser(user.UserID, user)
+}
+
+// updateUser 更新用户字段，values 为 User 时忽略零值，为 map 时按原样写入
+func (um *UserManager) updateUser(userID string, values interface{}) error {
+	old, err := um.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	values, err = um.sealValues(values)
+	if err != nil {
+		return err
+	}
+	err = um.users().Where("user_id = ?", userID).Omit(clause.Associations).Updates(values).Error
+	if err != nil {
+		return err
+	}
+
+	if um.device == "" {
+		return nil
+	}
+	updated, err := um.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	opened, err := um.OpenUser(*updated)
+	if err != nil {
+		return &ApplyError{Device: um.device, Err: err}
+	}
+	updated = &opened
+	var peers []wgtypes.PeerConfig
+	if old.PublicKey != updated.PublicKey {
+		remove, err := removePeerConfig(old.PublicKey)
+		if err != nil {
+			return &ApplyError{Device: um.device, Err: err}
+		}
+		peers = append(peers, remove)
+	}
+	peer, err := peerConfig(*updated)
+	if err != nil {
+		return &ApplyError{Device: um.device, Err: err}
+	}
+	return um.applyPeers(append(peers, peer)...)
 }
 
 func (um *UserManager) UpdateUserEndpoints(serverConfig ServerConfig) error {
 	endpoint := fmt.Sprintf("%s:%d", serverConfig.ServerIP, serverConfig.Port)
 
 	var users []User
-	err := um.db.Find(&users).Error
+	err := um.users().Find(&users).Error
 	if err != nil {
 		return err
 	}
 
 	for _, user := range users {
-		err := um.db.Model(&User{}).Where("user_id = ?", user.UserID).Update("endpoint", endpoint).Error
+		err := um.users().Where("user_id = ?", user.UserID).Update("endpoint", endpoint).Error
 		if err != nil {
 			return err
 		}
@@ -132,8 +644,48 @@ func (um *UserManager) UpdateUserEndpoints(serverConfig ServerConfig) error {
 }
 
 func (um *UserManager) DeleteUser(userID string) error {
-	err := um.db.Where("user_id = ?", userID).Delete(&User{}).Error
-	return err
+	var users []User
+	err := um.users().Where("user_id = ?", userID).Find(&users).Error
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	// 按主键删除查到的用户，避免越过分组的限制；同时删除用户广播的路由、与路由的接受关系以及分组成员关系
+	err = um.db.Transaction(func(tx *gorm.DB) error {
+		ids := make([]uint, 0, len(users))
+		for _, user := range users {
+			ids = append(ids, user.ID)
+			err := tx.Exec("DELETE FROM user_accepted_routes WHERE user_id = ? OR route_id IN (SELECT id FROM routes WHERE owner_id = ?)", user.ID, user.ID).Error
+			if err != nil {
+				return err
+			}
+			if err := tx.Where("owner_id = ?", user.ID).Delete(&Route{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("DELETE FROM group_members WHERE user_id = ?", user.ID).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&User{}, ids).Error
+	})
+	if err != nil {
+		return err
+	}
+	if err := um.releaseIPs(users); err != nil {
+		return err
+	}
+
+	var peers []wgtypes.PeerConfig
+	for _, user := range users {
+		peer, err := removePeerConfig(user.PublicKey)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return um.applyPeers(peers...)
 }
 
 // GenerateServerConfig generate server config
@@ -142,13 +694,21 @@ func (um *UserManager) GenerateServerConfig(serverConfig ServerConfig) (string,
 	if err != nil {
 		return "", err
 	}
+	users, err = um.openUsers(users)
+	if err != nil {
+		return "", err
+	}
+	serverConfig.PrivateKey, err = um.sealer.Open(serverConfig.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to open server private key: %w", err)
+	}
 
 	var configBuilder strings.Builder
 	configBuilder.WriteString(fmt.Sprintf(`[Interface]
 PrivateKey = %s
 Address = %s
 ListenPort = %d
-`, serverConfig.PrivateKey, serverConfig.IP, serverConfig.Port))
+`, serverConfig.PrivateKey, serverAddresses(serverConfig), serverConfig.Port))
 
 	if serverConfig.DNS != "" {
 		configBuilder.WriteString(fmt.Sprintf("DNS = %s\n", serverConfig.DNS))
@@ -162,27 +722,37 @@ ListenPort = %d
 	if serverConfig.PreUp != "" {
 		configBuilder.WriteString(fmt.Sprintf("PreUp = %s\n", serverConfig.PreUp))
 	}
+	// 访问控制策略在接口启动后加载，关闭后删除
+	policyUp, policyDown, err := um.policyHooks(serverConfig)
+	if err != nil {
+		return "", err
+	}
 	if serverConfig.PostUp != "" {
 		configBuilder.WriteString(fmt.Sprintf("PostUp = %s\n", serverConfig.PostUp))
 	}
+	if policyUp != "" {
+		configBuilder.WriteString(fmt.Sprintf("PostUp = %s\n", policyUp))
+	}
 	if serverConfig.PreDown != "" {
 		configBuilder.WriteString(fmt.Sprintf("PreDown = %s\n", serverConfig.PreDown))
 	}
 	if serverConfig.PostDown != "" {
 		configBuilder.WriteString(fmt.Sprintf("PostDown = %s\n", serverConfig.PostDown))
 	}
+	if policyDown != "" {
+		configBuilder.WriteString(fmt.Sprintf("PostDown = %s\n", policyDown))
+	}
 
-	for _, user := range users {
+	for _, user := range activeUsers(users, time.Now()) {
 		base := fmt.Sprintf(`[Peer]
 PublicKey = %s
 `, user.PublicKey)
-		if user.AdvertiseRoutes != "" {
-			base += fmt.Sprintf(`AllowedIPs = %s, %s 
-`, user.IP+"/32", user.AdvertiseRoutes)
-		} else {
-			base += fmt.Sprintf(`AllowedIPs = %s 
-`, user.IP+"/32")
+		if user.PresharedKey != "" {
+			base += fmt.Sprintf("PresharedKey = %s\n", user.PresharedKey)
 		}
+		allowedIPs := append(hostPrefixes(user), routePrefixes(user.AdvertisedRoutes, true)...)
+		base += fmt.Sprintf(`AllowedIPs = %s 
+`, strings.Join(allowedIPs, ", "))
 		configBuilder.WriteString(base)
 	}
 
@@ -235,34 +805,38 @@ func (um *UserManager) GetAllUserTraffic() (UserTrafficList, error) {
 	return trafficData, nil
 }
 
-// 生成密钥对
-func generateKeys() (string, string, error) {
-	privateKeyCmd := exec.Command("wg", "genkey")
-	privateKeyOut, err := privateKeyCmd.Output()
-	if err != nil {
-		return "", "", err
-	}
-	privateKey := strings.TrimSpace(string(privateKeyOut))
+// privateKeyPlaceholder 客户端自带密钥时，配置模板中私钥的占位符
+const privateKeyPlaceholder = "<insert>"
 
-	publicKeyCmd := exec.Command("wg", "pubkey")
-	publicKeyCmd.Stdin = strings.NewReader(privateKey)
-	publicKeyOut, err := publicKeyCmd.Output()
-	if err != nil {
-		return "", "", err
+// validatePublicKey 校验客户端提供的公钥
+func validatePublicKey(publicKey string) error {
+	if _, err := wgtypes.ParseKey(publicKey); err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
 	}
-	publicKey := strings.TrimSpace(string(publicKeyOut))
+	return nil
+}
 
-	return privateKey, publicKey, nil
+// clientAllowedIPs 客户端配置中 AllowedIPs 一行的内容，包含接受的启用的路由
+func clientAllowedIPs(user User) string {
+	accepted := routePrefixes(user.AcceptedRoutes, true)
+	if len(accepted) == 0 {
+		return user.AllowedIPs
+	}
+	return user.AllowedIPs + ", " + strings.Join(accepted, ", ")
 }
 
 // generate user config
 func generateUserConfig(serverConfig ServerConfig, user User) string {
 	var configBuilder strings.Builder
 
+	privateKey := user.PrivateKey
+	if privateKey == "" {
+		privateKey = privateKeyPlaceholder
+	}
 	configBuilder.WriteString(fmt.Sprintf(`[Interface]
 PrivateKey = %s
-Address = %s/32
-`, user.PrivateKey, user.IP))
+Address = %s
+`, privateKey, strings.Join(hostPrefixes(user), ", ")))
 
 	if user.PreUp != "" {
 		configBuilder.WriteString(fmt.Sprintf(`PreUp = %s
@@ -284,13 +858,11 @@ Address = %s/32
 [Peer]
 PublicKey = %s
 `, serverConfig.PublicKey))
-	if user.AcceptRoutes != "" {
-		configBuilder.WriteString(fmt.Sprintf(`AllowedIPs = %s, %s
-`, user.AllowedIPs, user.AcceptRoutes))
-	} else {
-		configBuilder.WriteString(fmt.Sprintf(`AllowedIPs = %s
-`, user.AllowedIPs))
+	if user.PresharedKey != "" {
+		configBuilder.WriteString(fmt.Sprintf("PresharedKey = %s\n", user.PresharedKey))
 	}
+	configBuilder.WriteString(fmt.Sprintf(`AllowedIPs = %s
+`, clientAllowedIPs(user)))
 
 	if user.Endpoint != "" {
 		configBuilder.WriteString(fmt.Sprintf("Endpoint = %s\n", user.Endpoint))
@@ -302,28 +874,19 @@ PublicKey = %s
 	return configBuilder.String()
 }
 
-// generateIPPool 根据 CIDR 生成 IP 池
-func generateIPPool(cidr string) ([]string, error) {
-	ip, ipnet, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return nil, err
-	}
-
-	var ips []string
-	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-		ips = append(ips, ip.String())
+// hostPrefixes 用户地址对应的主机前缀，双栈时包含 IPv6 地址
+func hostPrefixes(user User) []string {
+	prefixes := []string{user.IP + "/32"}
+	if user.IPv6 != "" {
+		prefixes = append(prefixes, user.IPv6+"/128")
 	}
-
-	// 去掉网络地址和广播地址
-	return ips[3 : len(ips)-1], nil
+	return prefixes
 }
 
-// inc 递增 IP 地址
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
-		}
+// serverAddresses 服务端配置中 Address 一行的内容
+func serverAddresses(serverConfig ServerConfig) string {
+	if serverConfig.IPv6 == "" {
+		return serverConfig.IP
 	}
+	return serverConfig.IP + ", " + serverConfig.IPv6
 }
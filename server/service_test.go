@@ -1,12 +1,47 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+
+	"gorm.io/gorm"
 )
 
+// testServerConfig 是各测试共用的 wg0 配置
+var testServerConfig = ServerConfig{
+	ServerIP:  "1.1.1.1",
+	Port:      51820,
+	PublicKey: "zlOEMUnIoBOoXTjOxAHbZ1MCjvFKZsHNhPCuTAVpSHM=",
+	IP:        "100.10.10.1/24",
+	IPPool:    "100.10.10.0/24",
+}
+
+// newTestUserManager 返回使用临时数据库和固定密钥的 UserManager
+func newTestUserManager(t *testing.T) *UserManager {
+	return openTestUserManager(t, filepath.Join(t.TempDir(), "users.db"))
+}
+
+// openTestUserManager 打开 dbPath 处的数据库，用于重新打开或共用数据库的测试。
+// 清除主密钥环境变量，避免测试读取运行者的密钥
+func openTestUserManager(t *testing.T, dbPath string) *UserManager {
+	t.Helper()
+	t.Setenv(masterKeyEnv, "")
+	t.Setenv(masterKeyFileEnv, "")
+	um, err := NewUserManager(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.SetKeyGenerator(&staticKeyGenerator{})
+	return um
+}
+
 func TestWgClient(t *testing.T) {
 	cli, err := wgctrl.New()
 	if err != nil {
@@ -38,3 +73,251 @@ func TestWgClient(t *testing.T) {
 	})
 
 }
+
+func TestAddUserDualStack(t *testing.T) {
+	um := newTestUserManager(t)
+
+	serverConfig := testServerConfig
+	serverConfig.IPv6 = "fd00:10::1/64"
+	serverConfig.IPPoolV6 = "fd00:10::/64"
+	for _, id := range []string{"alice", "bob"} {
+		if err := um.AddUser(serverConfig, &User{UserID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config, err := um.UserConfig(serverConfig, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "Address = 100.10.10.3/32, fd00:10::3/128") {
+		t.Errorf("client config lacks dual-stack address:\n%s", config)
+	}
+	serverConf, err := um.GenerateServerConfig(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Address = 100.10.10.1/24, fd00:10::1/64", "AllowedIPs = 100.10.10.2/32, fd00:10::2/128"} {
+		if !strings.Contains(serverConf, want) {
+			t.Errorf("server config lacks %q:\n%s", want, serverConf)
+		}
+	}
+}
+
+func TestAddUserConcurrent(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "users.db")
+	// 两个 UserManager 使用各自的连接，模拟 API 服务和命令行同时写入
+	var managers []*UserManager
+	for i := 0; i < 2; i++ {
+		um := openTestUserManager(t, dbPath)
+		// staticKeyGenerator 不能并发使用
+		um.SetKeyGenerator(wgKeyGenerator{})
+		managers = append(managers, um)
+	}
+
+	const workers = 40
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			um := managers[i%len(managers)]
+			errs <- um.AddUser(testServerConfig, &User{UserID: fmt.Sprintf("user-%d", i)})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	users, err := managers[0].GetAllUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != workers {
+		t.Fatalf("got %d users, want %d", len(users), workers)
+	}
+	seen := make(map[string]string)
+	for _, user := range users {
+		if other, ok := seen[user.IP]; ok {
+			t.Errorf("%s and %s share %s", user.UserID, other, user.IP)
+		}
+		seen[user.IP] = user.UserID
+	}
+
+	err = managers[1].AddUser(testServerConfig, &User{UserID: "user-0"})
+	if !errors.Is(err, ErrUserExists) {
+		t.Errorf("adding a duplicate user returned %v, want ErrUserExists", err)
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	um := newTestUserManager(t)
+	for _, user := range []*User{{UserID: "alice"}, {UserID: "bob", PostUp: "echo bob"}} {
+		if err := um.AddUser(testServerConfig, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := um.SetUserDisabled("bob", true); err != nil {
+		t.Fatal(err)
+	}
+	serverConf, err := um.GenerateServerConfig(testServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(serverConf, "[Peer]") != 1 || strings.Contains(serverConf, "100.10.10.3/32") {
+		t.Errorf("server config contains the disabled peer:\n%s", serverConf)
+	}
+	view, err := um.GetUserView("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !view.Disabled || view.IP != "100.10.10.3" || view.PostUp != "echo bob" {
+		t.Errorf("disabled bob = %+v, want the same IP and hooks", view)
+	}
+
+	// 禁用的用户仍然占用地址
+	carol := &User{UserID: "carol"}
+	if err := um.AddUser(testServerConfig, carol); err != nil {
+		t.Fatal(err)
+	}
+	if carol.IP != "100.10.10.4" {
+		t.Errorf("carol got %s, want 100.10.10.4", carol.IP)
+	}
+
+	if err := um.SetUserDisabled("bob", false); err != nil {
+		t.Fatal(err)
+	}
+	serverConf, err = um.GenerateServerConfig(testServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(serverConf, "AllowedIPs = 100.10.10.3/32 \n") {
+		t.Errorf("re-enabled bob is missing from the server config:\n%s", serverConf)
+	}
+	if err := um.SetUserDisabled("nobody", true); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("disabling an unknown user returned %v, want ErrRecordNotFound", err)
+	}
+}
+
+func TestRotatePresharedKey(t *testing.T) {
+	um := newTestUserManager(t)
+
+	if err := um.AddUser(testServerConfig, &User{UserID: "alice", PresharedKey: "psk-0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.AddUser(testServerConfig, &User{UserID: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.RotatePresharedKey("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err := um.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.PresharedKey == "psk-0" || alice.PresharedKey == "" {
+		t.Fatalf("preshared key was not rotated: %q", alice.PresharedKey)
+	}
+	config, err := um.UserConfig(testServerConfig, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "PresharedKey = "+alice.PresharedKey+"\n") {
+		t.Errorf("client config lacks the new preshared key:\n%s", config)
+	}
+	serverConf, err := um.GenerateServerConfig(testServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(serverConf, "PresharedKey = ") != 1 || !strings.Contains(serverConf, "PresharedKey = "+alice.PresharedKey+"\n") {
+		t.Errorf("server config should carry only alice's new preshared key:\n%s", serverConf)
+	}
+	if err := um.RotatePresharedKey("nobody"); err == nil {
+		t.Error("rotated the preshared key of an unknown user")
+	}
+}
+
+func TestRotateServerKey(t *testing.T) {
+	dir := t.TempDir()
+	um := openTestUserManager(t, filepath.Join(dir, "users.db"))
+	sealer := &KeySealer{key: [32]byte{1}}
+	um.SetSealer(sealer)
+
+	// server.yaml 描述的 wg0 写回文件，保留注释
+	configPath := filepath.Join(dir, "server.yaml")
+	err := os.WriteFile(configPath, []byte("server_ip: \"1.1.1.1\" # replace with your ip\nport: 51820\n"+
+		"private_key: \"old\"\npublic_key: \"old\"\nip: \"100.10.10.1/24\"\nip_pool: \"100.10.10.0/24\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := um.AddUser(testServerConfig, &User{UserID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	users, err := um.RotateServerKey(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].UserID != "alice" {
+		t.Errorf("users to redistribute = %v, want alice", users)
+	}
+	fileConfig, err := LoadServerConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileConfig.PublicKey != "public-2" || !isSealed(fileConfig.PrivateKey) {
+		t.Errorf("server.yaml keys = %q/%q, want a sealed private key and public-2", fileConfig.PrivateKey, fileConfig.PublicKey)
+	}
+	if key, err := sealer.Open(fileConfig.PrivateKey); err != nil || key != "private-2" {
+		t.Errorf("sealed private key opens to %q, %v, want private-2", key, err)
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "# replace with your ip") {
+		t.Errorf("server.yaml lost its comments:\n%s", data)
+	}
+	serverConf, err := um.GenerateServerConfig(*fileConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(serverConf, "PrivateKey = private-2\n") {
+		t.Errorf("server config lacks the new private key:\n%s", serverConf)
+	}
+	config, err := um.UserConfig(*fileConfig, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "PublicKey = public-2\n") {
+		t.Errorf("client config lacks the new server public key:\n%s", config)
+	}
+
+	// 其余接口写回数据库
+	if err := um.CreateInterface(&Interface{Name: "wg1", Port: 51821, IP: "100.20.20.1/24", IPPool: "100.20.20.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	wg1 := um.ForInterface("wg1")
+	if _, err := wg1.RotateServerKey(configPath); err != nil {
+		t.Fatal(err)
+	}
+	iface, err := um.GetInterface("wg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iface.PublicKey != "public-4" || !isSealed(iface.PrivateKey) {
+		t.Errorf("wg1 keys = %q/%q, want a sealed private key and public-4", iface.PrivateKey, iface.PublicKey)
+	}
+	if key, err := sealer.Open(iface.PrivateKey); err != nil || key != "private-4" {
+		t.Errorf("sealed wg1 private key opens to %q, %v, want private-4", key, err)
+	}
+	if fileConfig, err := LoadServerConfig(configPath); err != nil || fileConfig.PublicKey != "public-2" {
+		t.Errorf("rotating wg1 changed server.yaml: %+v, %v", fileConfig, err)
+	}
+}
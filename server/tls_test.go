@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureSelfSignedCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+
+	created, err := ensureSelfSignedCert(certFile, keyFile, []string{"vpn.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("expected certificate to be created")
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("vpn.example.com"); err != nil {
+		t.Error(err)
+	}
+
+	created, err = ensureSelfSignedCert(certFile, keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("existing certificate was regenerated")
+	}
+}